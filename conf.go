@@ -32,6 +32,10 @@ func InitConf(path string) {
 		initMysqlConn()
 	}
 
+	if len(Conf.ShardConf) > 0 {
+		initShardGroups()
+	}
+
 	if len(Conf.TenCentCOS) > 0 {
 		initTencentCOSClient()
 	}
@@ -55,36 +59,76 @@ func InitConf(path string) {
 	if len(Conf.MinIOConf) > 0 {
 		initMinioClient()
 	}
+
+	if len(Conf.PartitionConf) > 0 {
+		initPartitions()
+	}
+
+	if len(outboxes) > 0 {
+		startOutboxRelays()
+	}
 }
 
 type conf struct {
-	MysqlConf   []*MysqlConf   `yaml:"mysql"`
-	TenCentCOS  []*TenCentCOS  `yaml:"tencentCOS"`
-	MongoDBConf []*MongoDBConf `yaml:"mongoDB"`
-	RedisConf   []*RedisConf   `yaml:"redis"`
-	PgsqlConf   []*PgsqlConf   `yaml:"pgsql"`
-	AliYunOSS   []*AliYunOSS   `yaml:"aliYunOSS"`
-	MinIOConf   []*MinIOConf   `yaml:"minio"`
+	MysqlConf     []*MysqlConf     `yaml:"mysql"`
+	TenCentCOS    []*TenCentCOS    `yaml:"tencentCOS"`
+	MongoDBConf   []*MongoDBConf   `yaml:"mongoDB"`
+	RedisConf     []*RedisConf     `yaml:"redis"`
+	PgsqlConf     []*PgsqlConf     `yaml:"pgsql"`
+	AliYunOSS     []*AliYunOSS     `yaml:"aliYunOSS"`
+	MinIOConf     []*MinIOConf     `yaml:"minio"`
+	ShardConf     []*ShardConf     `yaml:"shards"`
+	PartitionConf []*PartitionConf `yaml:"partitions"`
 }
 
 type MysqlConf struct {
-	Tag             string `yaml:"tag"` // 标记,通过标记获得连接
-	User            string `yaml:"user"`
-	Password        string `yaml:"password"`
-	Host            string `yaml:"host"`
-	Port            int64  `yaml:"port"`
-	Database        string `yaml:"database"`
-	DisablePrepared bool   `yaml:"disablePrepared"` // 是否禁用预编译
-	MaxIdle         int64  `yaml:"maxIdle"`         // 最大空闲连接数
-	MaxOpen         int64  `yaml:"maxOpen"`         // 最大连接数
-	MaxLifeTime     int64  `yaml:"maxLife"`         // 连接最大存活时间 单位ms
-	MaxIdleTime     int64  `yaml:"maxIdleTime"`     // 连接最大空闲时间 单位ms
-	IsSSH           bool   `yaml:"isSSH"`           // t:开启  f:关闭
-	SSHUsername     string `yaml:"sshUser"`         // ssh 账号
-	SSHPassword     string `yaml:"sshPassword"`     // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
-	SSHPrivateKey   string `yaml:"sshPrivateKey"`   // ssh 密钥文件路径
-	SSHRemoteHost   string `yaml:"sshRemoteHost"`   // ssh 服务器地址
-	SSHRemotePort   int64  `yaml:"sshRemotePort"`   // ssh 服务器端口
+	Tag             string          `yaml:"tag"` // 标记,通过标记获得连接
+	User            string          `yaml:"user"`
+	Password        string          `yaml:"password"`
+	Host            string          `yaml:"host"`
+	Port            int64           `yaml:"port"`
+	Database        string          `yaml:"database"`
+	DisablePrepared bool            `yaml:"disablePrepared"` // 是否禁用预编译
+	MaxIdle         int64           `yaml:"maxIdle"`         // 最大空闲连接数
+	MaxOpen         int64           `yaml:"maxOpen"`         // 最大连接数
+	MaxLifeTime     int64           `yaml:"maxLife"`         // 连接最大存活时间 单位ms
+	MaxIdleTime     int64           `yaml:"maxIdleTime"`     // 连接最大空闲时间 单位ms
+	IsSSH           bool            `yaml:"isSSH"`           // t:开启  f:关闭
+	SSHUsername     string          `yaml:"sshUser"`         // ssh 账号
+	SSHPassword     string          `yaml:"sshPassword"`     // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
+	SSHPrivateKey   string          `yaml:"sshPrivateKey"`   // ssh 密钥文件路径
+	SSHPassphrase   string          `yaml:"sshPassphrase"`   // ssh 加密私钥的密码
+	SSHRemoteHost   string          `yaml:"sshRemoteHost"`   // ssh 服务器地址
+	SSHRemotePort   int64           `yaml:"sshRemotePort"`   // ssh 服务器端口
+	Audit           *AuditConf      `yaml:"audit"`           // 审计插件, 不配置则不启用
+	Cache           *QueryCacheConf `yaml:"cache"`           // 查询缓存插件, 不配置则不启用
+	Outbox          *OutboxConf     `yaml:"outbox"`          // 事务发件箱, 不配置则不启用
+}
+
+// OutboxConf 事务发件箱配置
+type OutboxConf struct {
+	RedisTag  string `yaml:"redisTag"`  // 发布到的redis标记, 为空时只写入不启动relay
+	Prefix    string `yaml:"prefix"`    // stream key 前缀, stream key 为 {prefix}{topic}
+	MaxLen    int64  `yaml:"maxLen"`    // stream 近似最大长度, 0不限制
+	Interval  int64  `yaml:"interval"`  // relay 轮询间隔 单位ms 默认1000
+	BatchSize int    `yaml:"batchSize"` // 每次发布的条数 默认100
+	MaxRetry  int    `yaml:"maxRetry"`  // 最大重试次数, 超过后不再发送 默认10
+	KeepSent  int64  `yaml:"keepSent"`  // 已发送消息保留时间 单位小时 默认72, 小于0不清理
+}
+
+// QueryCacheConf gorm查询缓存插件配置
+type QueryCacheConf struct {
+	RedisTag string `yaml:"redisTag"` // 保存缓存的redis标记
+	Prefix   string `yaml:"prefix"`   // 缓存key前缀 默认 dbHelper:cache
+}
+
+// AuditConf gorm审计插件配置
+type AuditConf struct {
+	Enable          bool   `yaml:"enable"`          // 是否启用: 填充 created_by/updated_by/tenant_id, version 列乐观锁
+	Tenant          bool   `yaml:"tenant"`          // 按上下文中的租户限定查询、更新、删除
+	History         string `yaml:"history"`         // 行变更历史 空:不记录 table:写入_audit表 mongo:写入mongo集合
+	MongoTag        string `yaml:"mongoTag"`        // history为mongo时使用的mongoDB标记
+	MongoCollection string `yaml:"mongoCollection"` // history为mongo时的集合名 默认_audit
 }
 
 // TenCentCOS 腾讯对象存储连接配置
@@ -110,43 +154,108 @@ type MongoDBConf struct {
 	SSHUsername     string `yaml:"sshUser"`         // ssh 账号
 	SSHPassword     string `yaml:"sshPassword"`     // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
 	SSHPrivateKey   string `yaml:"sshPrivateKey"`   // ssh 密钥文件路径
+	SSHPassphrase   string `yaml:"sshPassphrase"`   // ssh 加密私钥的密码
 	SSHRemoteHost   string `yaml:"sshRemoteHost"`   // ssh 服务器地址
 	SSHRemotePort   int64  `yaml:"sshRemotePort"`   // ssh 服务器端口
 }
 
 type RedisConf struct {
-	Tag             string `yaml:"tag"` // 标记,通过标记获得连接
-	Host            string `yaml:"host"`
-	Port            int    `yaml:"port"`
-	DB              int    `yaml:"db"`
-	Password        string `yaml:"password"`
-	PoolSize        int    `yaml:"poolSize"`
-	MinIdleConn     int    `yaml:"minIdleConn"`     // 最小空闲连接数
-	ConnMaxIdleTime int    `yaml:"connMaxIdleTime"` // 连接处于空闲状态的最长时间 单位秒
-	IsSSH           bool   `yaml:"isSSH"`           // t:开启  f:关闭
-	SSHUsername     string `yaml:"sshUser"`         // ssh 账号
-	SSHPassword     string `yaml:"sshPassword"`     // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
-	SSHPrivateKey   string `yaml:"sshPrivateKey"`   // ssh 密钥文件路径
-	SSHRemoteHost   string `yaml:"sshRemoteHost"`   // ssh 服务器地址
-	SSHRemotePort   int64  `yaml:"sshRemotePort"`   // ssh 服务器端口
+	Tag              string        `yaml:"tag"`  // 标记,通过标记获得连接
+	Mode             string        `yaml:"mode"` // single:单机 sentinel:哨兵 cluster:集群 默认single
+	Host             string        `yaml:"host"` // 单机模式的地址
+	Port             int           `yaml:"port"`
+	MasterName       string        `yaml:"masterName"`       // 哨兵模式的主节点名称
+	SentinelAddrs    []string      `yaml:"sentinelAddrs"`    // 哨兵模式的哨兵地址 host:port
+	SentinelPassword string        `yaml:"sentinelPassword"` // 哨兵的密码, 为空则不认证
+	Addrs            []string      `yaml:"addrs"`            // 集群模式的种子节点地址 host:port
+	DB               int           `yaml:"db"`               // 集群模式不支持
+	Username         string        `yaml:"username"`         // ACL 用户名(redis 6+), 为空使用 default 用户
+	Password         string        `yaml:"password"`
+	TLS              *RedisTLSConf `yaml:"tls"`          // TLS 连接, 不配置则不启用
+	DialTimeout      int64         `yaml:"dialTimeout"`  // 建立连接超时 单位ms 0使用默认值5000
+	ReadTimeout      int64         `yaml:"readTimeout"`  // 读超时 单位ms 0使用默认值3000, -1不限制, -2不设置deadline; 开启ssh时不生效
+	WriteTimeout     int64         `yaml:"writeTimeout"` // 写超时 单位ms 0与readTimeout相同, -1不限制, -2不设置deadline; 开启ssh时不生效
+	MaxRetries       int           `yaml:"maxRetries"`   // 命令失败最大重试次数 默认3, -1不重试
+	Protocol         int           `yaml:"protocol"`     // RESP 协议版本 2或3 默认3
+	PoolSize         int           `yaml:"poolSize"`
+	MinIdleConn      int           `yaml:"minIdleConn"`     // 最小空闲连接数
+	ConnMaxIdleTime  int           `yaml:"connMaxIdleTime"` // 连接处于空闲状态的最长时间 单位秒
+	IsSSH            bool          `yaml:"isSSH"`           // t:开启  f:关闭
+	SSHUsername      string        `yaml:"sshUser"`         // ssh 账号
+	SSHPassword      string        `yaml:"sshPassword"`     // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
+	SSHPrivateKey    string        `yaml:"sshPrivateKey"`   // ssh 密钥文件路径
+	SSHPassphrase    string        `yaml:"sshPassphrase"`   // ssh 加密私钥的密码
+	SSHRemoteHost    string        `yaml:"sshRemoteHost"`   // ssh 服务器地址
+	SSHRemotePort    int64         `yaml:"sshRemotePort"`   // ssh 服务器端口
+}
+
+// RedisTLSConf redis TLS 配置, 证书均为文件路径
+type RedisTLSConf struct {
+	CA         string `yaml:"ca"`         // CA证书, 为空使用系统根证书
+	Cert       string `yaml:"cert"`       // 客户端证书
+	Key        string `yaml:"key"`        // 客户端私钥
+	ServerName string `yaml:"serverName"` // 校验的服务端名称, 为空使用连接地址的主机名
+	SkipVerify bool   `yaml:"skipVerify"` // 跳过服务端证书校验
 }
 
 type PgsqlConf struct {
-	Tag           string `yaml:"tag"` // 标记,通过标记获得连接
-	User          string `yaml:"user"`
-	Password      string `yaml:"password"`
-	Host          string `yaml:"host"`
-	Port          int64  `yaml:"port"`
-	Database      string `yaml:"database"`
-	MaxIdle       int64  `yaml:"maxIdle"`       // 最大空闲连接数
-	MaxOpen       int64  `yaml:"maxOpen"`       // 最大连接数
-	MaxLifeTime   int64  `yaml:"maxLife"`       // 连接最大存活时间 单位ms
-	IsSSH         bool   `yaml:"isSSH"`         // t:开启  f:关闭
-	SSHUsername   string `yaml:"sshUser"`       // ssh 账号
-	SSHPassword   string `yaml:"sshPassword"`   // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
-	SSHPrivateKey string `yaml:"sshPrivateKey"` // ssh 密钥文件路径
-	SSHRemoteHost string `yaml:"sshRemoteHost"` // ssh 服务器地址
-	SSHRemotePort int64  `yaml:"sshRemotePort"` // ssh 服务器端口
+	Tag              string `yaml:"tag"` // 标记,通过标记获得连接
+	User             string `yaml:"user"`
+	Password         string `yaml:"password"`
+	Host             string `yaml:"host"`
+	Port             int64  `yaml:"port"`
+	Database         string `yaml:"database"`
+	SSLMode          string `yaml:"sslMode"`          // disable allow prefer require verify-ca verify-full 默认disable
+	SSLRootCert      string `yaml:"sslRootCert"`      // CA证书文件路径
+	SSLCert          string `yaml:"sslCert"`          // 客户端证书文件路径
+	SSLKey           string `yaml:"sslKey"`           // 客户端私钥文件路径
+	SearchPath       string `yaml:"searchPath"`       // schema 搜索路径, 如 "app,public"
+	ApplicationName  string `yaml:"applicationName"`  // 应用名称, 显示在 pg_stat_activity 中
+	ConnectTimeout   int64  `yaml:"connectTimeout"`   // 连接超时 单位秒, 0不限制
+	StatementTimeout int64  `yaml:"statementTimeout"` // 语句执行超时 单位ms, 0不限制
+	MaxIdle          int64  `yaml:"maxIdle"`          // 最大空闲连接数
+	MaxOpen          int64  `yaml:"maxOpen"`          // 最大连接数
+	MaxLifeTime      int64  `yaml:"maxLife"`          // 连接最大存活时间 单位ms
+	MaxIdleTime      int64  `yaml:"maxIdleTime"`      // 连接最大空闲时间 单位ms
+	LogLevel         string `yaml:"logLevel"`         // sql日志级别 silent error warn info 默认info
+	SlowThreshold    int64  `yaml:"slowThreshold"`    // 慢查询阈值 单位ms 默认200, 小于0不输出慢查询
+	LogArgs          bool   `yaml:"logArgs"`          // sql日志是否输出参数值, 默认只输出参数个数
+	IsSSH            bool   `yaml:"isSSH"`            // t:开启  f:关闭
+	SSHUsername      string `yaml:"sshUser"`          // ssh 账号
+	SSHPassword      string `yaml:"sshPassword"`      // ssh 密码认证; 当SSHPrivateKey同时设置，优先使用密钥认证
+	SSHPrivateKey    string `yaml:"sshPrivateKey"`    // ssh 密钥文件路径
+	SSHPassphrase    string `yaml:"sshPassphrase"`    // ssh 加密私钥的密码
+	SSHRemoteHost    string `yaml:"sshRemoteHost"`    // ssh 服务器地址
+	SSHRemotePort    int64  `yaml:"sshRemotePort"`    // ssh 服务器端口
+}
+
+// ShardConf mysql分片组配置, 组内每个分片对应一个mysql标记
+type ShardConf struct {
+	Group        string        `yaml:"group"`        // 分片组名,通过组名获得分片连接
+	Strategy     string        `yaml:"strategy"`     // 分片策略 mod:取模 consistent:一致性哈希 range:范围表
+	Tags         []string      `yaml:"tags"`         // 组内的mysql标记, mod策略按此顺序取模
+	VirtualNodes int           `yaml:"virtualNodes"` // 一致性哈希每个标记的虚拟节点数 默认160
+	Ranges       []*ShardRange `yaml:"ranges"`       // range策略的范围表
+}
+
+// ShardRange 范围分片, 分片键落在 [start, end) 时路由到 tag, end 为0表示不限上界
+type ShardRange struct {
+	Tag   string `yaml:"tag"`
+	Start int64  `yaml:"start"`
+	End   int64  `yaml:"end"`
+}
+
+// PartitionConf 按月分区表配置, 分区表名为 {table}_YYYYMM
+type PartitionConf struct {
+	Tag          string `yaml:"tag"`          // mysql或pgsql标记
+	Table        string `yaml:"table"`        // 基础表名,通过表名获得分区
+	Mode         string `yaml:"mode"`         // clone:按基础表结构创建月表 native:数据库原生RANGE分区 默认clone
+	Precreate    int    `yaml:"precreate"`    // 预创建未来几个月的分区 默认3
+	Retention    int    `yaml:"retention"`    // 保留当前月之前几个月的分区, 更早的分区会被清理, 0不清理
+	ArchiveTag   string `yaml:"archiveTag"`   // 清理前将分区数据复制到该 mysql/pgsql/mongoDB 标记, 为空直接删除
+	ArchiveTable string `yaml:"archiveTable"` // 归档的目标表或集合, 为空与分区表同名
+	PrimaryKey   string `yaml:"primaryKey"`   // 归档时按此主键分页读取 默认id
+	Interval     int64  `yaml:"interval"`     // 维护任务执行间隔 单位秒 默认3600
 }
 
 type AliYunOSS struct {
@@ -0,0 +1,525 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CopyTableSpec 跨库复制表的参数
+type CopyTableSpec struct {
+	SrcTable      string                                                           // 源表名
+	DstTable      string                                                           // 目标表名或mongo集合名, 为空则与源表同名
+	PrimaryKey    string                                                           // 源表主键, 单列且可排序, 用于游标分页, 默认 id
+	Columns       []string                                                         // 读取的源列, 为空则读取全部列
+	ColumnMap     map[string]string                                                // 列映射 源列名 -> 目标列名, 未配置的列保持原名
+	Transform     func(row map[string]interface{}) (map[string]interface{}, error) // 逐行转换(列映射之后执行), 返回nil或空map则跳过该行
+	BatchSize     int                                                              // 每批读取与写入的行数 默认1000
+	Workers       int                                                              // 并行写入的协程数 默认1
+	Checkpoint    CopyCheckpoint                                                   // 断点存储, 为空则每次从头复制
+	CheckpointKey string                                                           // 断点标识, 默认 srcTag:srcTable->dstTag:dstTable
+	Upsert        bool                                                             // 目标已有相同主键(列映射后的主键列)的行时覆盖, 重复执行不会产生重复数据; sql 目标需在该列上有主键或唯一索引, mongoDB 按该字段替换文档
+}
+
+// CopyCheckpoint 断点存储, 保存已完成复制的最大主键, 值为主键的json编码, 数字主键恢复后仍为数字
+type CopyCheckpoint interface {
+	Load(ctx context.Context, key string) (string, error) // 无断点时返回空字符串
+	Save(ctx context.Context, key, value string) error
+}
+
+// CopyTable 从 mysql/pgsql 标记的源表按主键游标分页读取, 批量写入 mysql/pgsql/mongoDB 标记的目标表
+// 返回本次复制的行数; 配置断点后再次执行会从上次完成的主键之后继续
+func CopyTable(ctx context.Context, srcTag, dstTag string, spec *CopyTableSpec) (int64, error) {
+	if spec == nil || spec.SrcTable == "" {
+		return 0, fmt.Errorf("[CopyTable] 未指定源表")
+	}
+	if spec.DstTable == "" {
+		spec.DstTable = spec.SrcTable
+	}
+	if spec.PrimaryKey == "" {
+		spec.PrimaryKey = "id"
+	}
+	if spec.BatchSize < 1 {
+		spec.BatchSize = 1000
+	}
+	if spec.Workers < 1 {
+		spec.Workers = 1
+	}
+	if spec.CheckpointKey == "" {
+		spec.CheckpointKey = fmt.Sprintf("%s:%s->%s:%s", srcTag, spec.SrcTable, dstTag, spec.DstTable)
+	}
+
+	src, dialect, err := getSqlDB(srcTag)
+	if err != nil {
+		return 0, err
+	}
+	writer, err := newCopyWriter(dstTag, spec)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastKey interface{}
+	if spec.Checkpoint != nil {
+		v, err := spec.Checkpoint.Load(ctx, spec.CheckpointKey)
+		if err != nil {
+			return 0, err
+		}
+		if v != "" {
+			lastKey = decodeCopyKey(v)
+			InfoF("[CopyTable] %s 从断点 %s 继续", spec.CheckpointKey, v)
+		}
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan *copyBatch, spec.Workers)
+	results := make(chan *copyBatch, spec.Workers)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(batches)
+		readErr <- readCopyBatches(ctx, src, dialect, spec, lastKey, batches)
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < spec.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				b.err = writeCopyBatch(ctx, writer, spec, b)
+				results <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// 批次可能乱序完成, 只有连续完成的批次才推进断点
+	var (
+		copied   int64
+		firstErr error
+		next     int64
+		done     = make(map[int64]*copyBatch)
+	)
+	for b := range results {
+		if b.err != nil {
+			if firstErr == nil {
+				firstErr = b.err
+				cancel()
+			}
+			continue
+		}
+		copied += b.written
+		done[b.seq] = b
+		for {
+			nb, ok := done[next]
+			if !ok {
+				break
+			}
+			delete(done, next)
+			next++
+			if spec.Checkpoint != nil && firstErr == nil {
+				if err := spec.Checkpoint.Save(ctx, spec.CheckpointKey, encodeCopyKey(nb.lastKey)); err != nil {
+					firstErr = err
+					cancel()
+				}
+			}
+		}
+		InfoF("[CopyTable] %s 已复制 %d 行", spec.CheckpointKey, copied)
+	}
+
+	// 写入出错时读取因内部 cancel 结束, 忽略读取的错误; 否则读取出错或调用方取消都表示复制未完成
+	if err := <-readErr; firstErr == nil && err != nil {
+		if parent.Err() != nil {
+			err = parent.Err()
+		}
+		firstErr = err
+	}
+	return copied, firstErr
+}
+
+// encodeCopyKey 断点按json保存, 保留主键的类型, 数字主键不会变成字符串比较
+func encodeCopyKey(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return AnyToString(v)
+	}
+	return string(b)
+}
+
+// decodeCopyKey 解析断点, 兼容旧版本直接保存的字符串
+func decodeCopyKey(s string) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return s
+	}
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+type copyBatch struct {
+	seq     int64
+	rows    []map[string]interface{}
+	lastKey interface{}
+	written int64
+	err     error
+}
+
+func readCopyBatches(ctx context.Context, db *sql.DB, dialect sqlDialect, spec *CopyTableSpec,
+	lastKey interface{}, out chan<- *copyBatch) error {
+
+	columns := "*"
+	if len(spec.Columns) > 0 {
+		cols := make([]string, 0, len(spec.Columns)+1)
+		if !SliceContains(spec.Columns, spec.PrimaryKey) {
+			cols = append(cols, dialect.quote(spec.PrimaryKey))
+		}
+		for _, c := range spec.Columns {
+			cols = append(cols, dialect.quote(c))
+		}
+		columns = strings.Join(cols, ", ")
+	}
+	pk := dialect.quote(spec.PrimaryKey)
+
+	for seq := int64(0); ; seq++ {
+		query := fmt.Sprintf("SELECT %s FROM %s", columns, dialect.quote(spec.SrcTable))
+		args := make([]interface{}, 0, 1)
+		if lastKey != nil {
+			query += fmt.Sprintf(" WHERE %s > %s", pk, dialect.placeholder(1))
+			args = append(args, lastKey)
+		}
+		query += fmt.Sprintf(" ORDER BY %s LIMIT %d", pk, spec.BatchSize)
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		list, err := scanMaps(rows)
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return nil
+		}
+
+		lastKey = list[len(list)-1][spec.PrimaryKey]
+		select {
+		case out <- &copyBatch{seq: seq, rows: list, lastKey: lastKey}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if len(list) < spec.BatchSize {
+			return nil
+		}
+	}
+}
+
+func writeCopyBatch(ctx context.Context, w copyWriter, spec *CopyTableSpec, b *copyBatch) error {
+	rows := make([]map[string]interface{}, 0, len(b.rows))
+	for _, row := range b.rows {
+		mapped := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			if name, ok := spec.ColumnMap[k]; ok && name != "" {
+				k = name
+			}
+			mapped[k] = v
+		}
+		if spec.Transform != nil {
+			var err error
+			mapped, err = spec.Transform(mapped)
+			if err != nil {
+				return err
+			}
+			if len(mapped) == 0 {
+				continue
+			}
+		}
+		rows = append(rows, mapped)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := w.write(ctx, rows); err != nil {
+		return err
+	}
+	b.written = int64(len(rows))
+	return nil
+}
+
+// copyWriter 复制目标
+type copyWriter interface {
+	write(ctx context.Context, rows []map[string]interface{}) error
+}
+
+func newCopyWriter(tag string, spec *CopyTableSpec) (copyWriter, error) {
+	pk := ""
+	if spec.Upsert {
+		pk = spec.PrimaryKey
+		if name, ok := spec.ColumnMap[pk]; ok && name != "" {
+			pk = name
+		}
+	}
+	if mdb, ok := MongoDBConn[tag]; ok {
+		return &mongoCopyWriter{coll: mdb.Collection(spec.DstTable), upsertKey: pk}, nil
+	}
+	db, dialect, err := getSqlDB(tag)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlCopyWriter{db: db, dialect: dialect, table: spec.DstTable, upsertKey: pk}, nil
+}
+
+type sqlCopyWriter struct {
+	db        *sql.DB
+	dialect   sqlDialect
+	table     string
+	upsertKey string // 非空时主键冲突则覆盖
+}
+
+// sqlMaxParams 单条语句的最大参数个数, mysql 与 pgsql 的上限都是 65535
+const sqlMaxParams = 60000
+
+// write 按列集合分组写入, 行中没有的列不出现在 INSERT 中, 由目标表的默认值填充
+func (w *sqlCopyWriter) write(ctx context.Context, rows []map[string]interface{}) error {
+	var (
+		order  []string
+		groups = make(map[string][]map[string]interface{})
+	)
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		sig := strings.Join(rowsColumns([]map[string]interface{}{row}), "\x00")
+		if _, ok := groups[sig]; !ok {
+			order = append(order, sig)
+		}
+		groups[sig] = append(groups[sig], row)
+	}
+	for _, sig := range order {
+		if err := w.insert(ctx, groups[sig]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *sqlCopyWriter) insert(ctx context.Context, rows []map[string]interface{}) error {
+	columns := rowsColumns(rows)
+	if len(columns) == 0 {
+		return fmt.Errorf("[CopyTable] %s 写入的行没有任何列", w.table)
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = w.dialect.quote(c)
+	}
+
+	perStmt := sqlMaxParams / len(columns)
+	for start := 0; start < len(rows); start += perStmt {
+		end := start + perStmt
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var sb strings.Builder
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		sb.WriteString(fmt.Sprintf("INSERT INTO %s (%s) VALUES ", w.dialect.quote(w.table), strings.Join(quoted, ", ")))
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(")
+			for j, c := range columns {
+				if j > 0 {
+					sb.WriteString(", ")
+				}
+				args = append(args, row[c])
+				sb.WriteString(w.dialect.placeholder(len(args)))
+			}
+			sb.WriteString(")")
+		}
+		if w.upsertKey != "" {
+			sb.WriteString(w.upsertClause(columns))
+		}
+
+		if _, err := w.db.ExecContext(ctx, sb.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertClause 主键冲突时用新值覆盖除主键外的列
+func (w *sqlCopyWriter) upsertClause(columns []string) string {
+	key := w.dialect.quote(w.upsertKey)
+	sets := make([]string, 0, len(columns))
+	for _, c := range columns {
+		if c == w.upsertKey {
+			continue
+		}
+		if w.dialect == dialectMysql {
+			sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", w.dialect.quote(c), w.dialect.quote(c)))
+		} else {
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", w.dialect.quote(c), w.dialect.quote(c)))
+		}
+	}
+	switch {
+	case w.dialect == dialectMysql && len(sets) == 0:
+		return fmt.Sprintf(" ON DUPLICATE KEY UPDATE %s = %s", key, key)
+	case w.dialect == dialectMysql:
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	case len(sets) == 0:
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", key)
+	default:
+		return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", key, strings.Join(sets, ", "))
+	}
+}
+
+// rowsColumns 一批数据中出现过的全部列, 按名称排序
+func rowsColumns(rows []map[string]interface{}) []string {
+	set := make(map[string]struct{})
+	for _, row := range rows {
+		for k := range row {
+			set[k] = struct{}{}
+		}
+	}
+	columns := make([]string, 0, len(set))
+	for k := range set {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+type mongoCopyWriter struct {
+	coll      *mongo.Collection
+	upsertKey string // 非空时按该字段替换已有文档
+}
+
+func (w *mongoCopyWriter) write(ctx context.Context, rows []map[string]interface{}) error {
+	if w.upsertKey == "" {
+		docs := make([]interface{}, len(rows))
+		for i, row := range rows {
+			docs[i] = bson.M(row)
+		}
+		_, err := w.coll.InsertMany(ctx, docs)
+		return err
+	}
+
+	models := make([]mongo.WriteModel, len(rows))
+	for i, row := range rows {
+		key, ok := row[w.upsertKey]
+		if !ok {
+			models[i] = mongo.NewInsertOneModel().SetDocument(bson.M(row))
+			continue
+		}
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{w.upsertKey: key}).SetReplacement(bson.M(row)).SetUpsert(true)
+	}
+	_, err := w.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// NewFileCheckpoint 断点保存到本地json文件, 文件中可保存多个断点
+func NewFileCheckpoint(path string) CopyCheckpoint {
+	return &fileCheckpoint{path: path}
+}
+
+type fileCheckpoint struct {
+	path string
+	mux  sync.Mutex
+}
+
+func (f *fileCheckpoint) read() (map[string]string, error) {
+	data := make(map[string]string)
+	if !FileExists(f.path) {
+		return data, nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return data, nil
+	}
+	err = json.Unmarshal(b, &data)
+	return data, err
+}
+
+func (f *fileCheckpoint) Load(ctx context.Context, key string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	data, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	return data[key], nil
+}
+
+func (f *fileCheckpoint) Save(ctx context.Context, key, value string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	data, err := f.read()
+	if err != nil {
+		return err
+	}
+	data[key] = value
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名, 避免写入中断损坏断点
+	tmp := f.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// NewRedisCheckpoint 断点保存到redis标记的连接, key 为 dbHelper:copy:checkpoint:{CheckpointKey}
+func NewRedisCheckpoint(tag string) CopyCheckpoint {
+	return &redisCheckpoint{rdb: GetRedisConn(tag)}
+}
+
+type redisCheckpoint struct {
+	rdb redis.UniversalClient
+}
+
+func (r *redisCheckpoint) Load(ctx context.Context, key string) (string, error) {
+	v, err := r.rdb.Get(ctx, "dbHelper:copy:checkpoint:"+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+func (r *redisCheckpoint) Save(ctx context.Context, key, value string) error {
+	return r.rdb.Set(ctx, "dbHelper:copy:checkpoint:"+key, value, 0).Err()
+}
@@ -0,0 +1,188 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ErrLockNotHeld 解锁时当前 Locker 未持有该锁
+var ErrLockNotHeld = errors.New("lock not held")
+
+// Locker 分布式锁
+// 锁的生命周期与 Lock/TryLock 传入的 ctx 绑定, ctx 结束或持有超过 ttl 时自动释放, ttl 为0表示不限制
+type Locker interface {
+	Lock(ctx context.Context, name string, ttl time.Duration) error
+	TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error)
+	Unlock(ctx context.Context, name string) error
+}
+
+// NewPgLocker 基于 pg_advisory_lock 的分布式锁, 锁名哈希为 int64 作为 advisory lock key
+func NewPgLocker(tag string) Locker {
+	return &sqlLocker{db: GetPgsqlConn(tag), dialect: dialectPostgres, held: make(map[string]*heldLock)}
+}
+
+// NewMysqlLocker 基于 GET_LOCK/RELEASE_LOCK 的分布式锁, 超过64个字符的锁名使用其MD5
+func NewMysqlLocker(tag string) Locker {
+	db, err := GetMysqlConn(tag).DB()
+	if err != nil {
+		panic(err)
+	}
+	return &sqlLocker{db: db, dialect: dialectMysql, held: make(map[string]*heldLock)}
+}
+
+// sqlLocker 锁持有在从连接池取出的专用连接上, 释放后连接归还连接池
+type sqlLocker struct {
+	db      *sql.DB
+	dialect sqlDialect
+	mux     sync.Mutex
+	held    map[string]*heldLock
+}
+
+type heldLock struct {
+	name string
+	conn *sql.Conn
+	stop chan struct{}
+	once sync.Once
+}
+
+func (l *sqlLocker) Lock(ctx context.Context, name string, ttl time.Duration) error {
+	ok, err := l.acquire(ctx, name, ttl, true)
+	if err == nil && !ok {
+		err = fmt.Errorf("[Locker] 获取锁 %s 失败", name)
+	}
+	return err
+}
+
+func (l *sqlLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return l.acquire(ctx, name, ttl, false)
+}
+
+func (l *sqlLocker) Unlock(ctx context.Context, name string) error {
+	l.mux.Lock()
+	h, ok := l.held[name]
+	l.mux.Unlock()
+	if !ok {
+		return ErrLockNotHeld
+	}
+	return l.release(ctx, h)
+}
+
+func (l *sqlLocker) acquire(ctx context.Context, name string, ttl time.Duration, wait bool) (bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var acquired sql.NullInt64
+	switch l.dialect {
+	case dialectPostgres:
+		if wait {
+			_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", pgLockKey(name))
+			acquired.Int64, acquired.Valid = 1, true
+		} else {
+			var ok bool
+			err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", pgLockKey(name)).Scan(&ok)
+			if ok {
+				acquired.Int64 = 1
+			}
+			acquired.Valid = true
+		}
+	default:
+		timeout := 0
+		if wait {
+			timeout = -1
+		}
+		err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", mysqlLockName(name), timeout).Scan(&acquired)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return false, err
+	}
+	if !acquired.Valid {
+		_ = conn.Close()
+		return false, fmt.Errorf("[Locker] 获取锁 %s 出错", name)
+	}
+	if acquired.Int64 != 1 {
+		_ = conn.Close()
+		return false, nil
+	}
+
+	h := &heldLock{name: name, conn: conn, stop: make(chan struct{})}
+	l.mux.Lock()
+	l.held[name] = h
+	l.mux.Unlock()
+
+	// ctx 结束或超过 ttl 时自动释放
+	go func() {
+		var expire <-chan time.Time
+		if ttl > 0 {
+			timer := time.NewTimer(ttl)
+			defer timer.Stop()
+			expire = timer.C
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-ctx.Done():
+			InfoF("[Locker] 上下文结束, 自动释放锁 %s", name)
+		case <-expire:
+			WarnF("[Locker] 持有超过 %v, 自动释放锁 %s", ttl, name)
+		}
+		_ = l.release(context.Background(), h)
+	}()
+
+	return true, nil
+}
+
+func (l *sqlLocker) release(ctx context.Context, h *heldLock) error {
+	var err error
+	h.once.Do(func() {
+		close(h.stop)
+
+		// 先移出再解锁, 避免覆盖其他协程随后获取到的同名锁
+		l.mux.Lock()
+		if l.held[h.name] == h {
+			delete(l.held, h.name)
+		}
+		l.mux.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		switch l.dialect {
+		case dialectPostgres:
+			_, err = h.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", pgLockKey(h.name))
+		default:
+			_, err = h.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", mysqlLockName(h.name))
+		}
+		if err != nil {
+			ErrorF("[Locker] 释放锁 %s 失败, 关闭连接: %v", h.name, err)
+			// 解锁失败时丢弃该连接, 连接断开后数据库会释放锁
+			_ = h.conn.Raw(func(driverConn interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+		_ = h.conn.Close()
+	})
+	return err
+}
+
+// pgLockKey 锁名哈希为 advisory lock 的 int64 key
+func pgLockKey(name string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// mysqlLockName GET_LOCK 的锁名最长64个字符
+func mysqlLockName(name string) string {
+	if len(name) > 64 {
+		return MD5(name)
+	}
+	return name
+}
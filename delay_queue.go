@@ -0,0 +1,386 @@
+package dbHelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+// 把到期的任务从有序集合移到就绪列表, KEYS: scheduled, ready; ARGV: 当前毫秒, 单次最多条数
+var delayQueueMoveScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+	redis.call('RPUSH', KEYS[2], unpack(due))
+end
+return #due
+`)
+
+// 从就绪列表取出一个任务, 同时在有序集合中登记租约(到期时间), 处理超时或进程崩溃后任务会重新到期
+// KEYS: scheduled, ready, jobs, attempts; ARGV: 租约到期毫秒; 返回 {id, payload, 第几次执行}, 没有任务时返回空
+var delayQueueClaimScript = redis.NewScript(`
+while true do
+	local id = redis.call('LPOP', KEYS[2])
+	if not id then
+		return {}
+	end
+	local payload = redis.call('HGET', KEYS[3], id)
+	-- 已取消的任务只剩列表中的id
+	if payload then
+		redis.call('ZADD', KEYS[1], ARGV[1], id)
+		local attempts = redis.call('HINCRBY', KEYS[4], id, 1)
+		return {id, payload, attempts}
+	end
+end
+`)
+
+// KEYS: scheduled, ready, jobs, attempts; ARGV: id
+var delayQueueCancelScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('LREM', KEYS[2], 0, ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+return redis.call('HDEL', KEYS[3], ARGV[1])
+`)
+
+// KEYS: scheduled, ready, jobs; ARGV: id, 执行时间毫秒
+var delayQueueRescheduleScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[3], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LREM', KEYS[2], 0, ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// 新增任务, id 已存在时不覆盖并返回0; KEYS: scheduled, jobs; ARGV: id, payload, 执行时间毫秒
+var delayQueueEnqueueScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[2], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// 执行失败后设置重试时间, 执行期间被 Reschedule 或取消(分数不再是租约到期时间)时不修改
+// KEYS: scheduled; ARGV: id, 租约到期毫秒, 重试时间毫秒
+var delayQueueRetryScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) == tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// DelayJob 延时任务, Attempts 为第几次执行
+type DelayJob struct {
+	ID       string
+	Queue    string
+	Payload  string
+	Attempts int64
+	lease    int64 // 租约到期毫秒, 也是取出时在有序集合中的分数
+}
+
+// Decode 把json格式的 Payload 解析到 v
+func (j *DelayJob) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// DelayHandler 执行任务, 返回错误或 panic 时按退避时间重试
+type DelayHandler func(ctx context.Context, job *DelayJob) error
+
+// DelayQueueOptions 延时队列参数
+type DelayQueueOptions struct {
+	Concurrency  int           // 每个队列同时执行的任务数 默认10
+	PollInterval time.Duration // 检查到期任务的间隔, 也是任务最多延后执行的时间 默认1秒
+	Visibility   time.Duration // 任务执行超过此时间未完成时重新投递, 应大于单个任务的最长耗时 默认5分钟
+	MaxAttempts  int64         // 最多执行次数, 超过后移入 {queue}:dead 列表 默认5
+	DrainTimeout time.Duration // 停止时等待执行中任务的最长时间, 超时后取消 handler 的 ctx 默认30秒
+}
+
+// DelayQueue 基于 redis 有序集合的延时任务队列, 任务保存在redis中, 重启后不丢失
+// 到期任务由 lua 脚本原子地移到就绪列表, 投递语义为至少一次, handler 应保证幂等
+// 同一个队列的key使用相同的 hash tag, 集群模式下在同一个slot
+type DelayQueue struct {
+	tag string
+	opt DelayQueueOptions
+}
+
+// NewDelayQueue 在redis标记上创建延时队列
+func NewDelayQueue(tag string, opt *DelayQueueOptions) *DelayQueue {
+	GetRedisConn(tag)
+	q := &DelayQueue{tag: tag}
+	if opt != nil {
+		q.opt = *opt
+	}
+	if q.opt.Concurrency < 1 {
+		q.opt.Concurrency = 10
+	}
+	if q.opt.PollInterval <= 0 {
+		q.opt.PollInterval = time.Second
+	}
+	if q.opt.Visibility <= 0 {
+		q.opt.Visibility = 5 * time.Minute
+	}
+	if q.opt.MaxAttempts < 1 {
+		q.opt.MaxAttempts = 5
+	}
+	if q.opt.DrainTimeout <= 0 {
+		q.opt.DrainTimeout = 30 * time.Second
+	}
+	return q
+}
+
+func (q *DelayQueue) redis() redis.UniversalClient {
+	return GetRedisConn(q.tag)
+}
+
+// keys 依次为 scheduled(有序集合 id -> 执行时间), ready(就绪列表), jobs(id -> payload), attempts(id -> 执行次数)
+func (q *DelayQueue) keys(queue string) []string {
+	prefix := "dbHelper:delay:{" + queue + "}:"
+	return []string{prefix + "scheduled", prefix + "ready", prefix + "jobs", prefix + "attempts"}
+}
+
+func (q *DelayQueue) deadKey(queue string) string {
+	return "dbHelper:delay:{" + queue + "}:dead"
+}
+
+// Enqueue 添加任务, 在 runAt 之后执行, 返回任务id
+// payload 为 string/[]byte 时原样保存, 其余类型序列化为json
+func (q *DelayQueue) Enqueue(ctx context.Context, queue string, payload interface{}, runAt time.Time) (string, error) {
+	var data string
+	switch v := payload.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		data = string(b)
+	}
+
+	// id 由 ID64 生成, 多个实例的 workerId 相同时可能重复, 重复时换一个id, 不覆盖已有任务
+	keys := q.keys(queue)
+	for i := 0; i < 3; i++ {
+		id, err := ID64()
+		if err != nil {
+			return "", err
+		}
+		jobId := AnyToString(id)
+		n, err := delayQueueEnqueueScript.Run(ctx, q.redis(), []string{keys[0], keys[2]}, jobId, data, runAt.UnixMilli()).Int64()
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			return jobId, nil
+		}
+		WarnF("[DelayQueue] %s 任务id %s 已存在, 请通过 SetIdWorker 为每个实例设置不同的 workerId", queue, jobId)
+	}
+	return "", fmt.Errorf("[DelayQueue] %s 生成任务id重复", queue)
+}
+
+// Cancel 取消任务, 任务不存在或已完成时返回 false; 正在执行的任务不会被中断, 但不会再重试
+func (q *DelayQueue) Cancel(ctx context.Context, queue, id string) (bool, error) {
+	n, err := delayQueueCancelScript.Run(ctx, q.redis(), q.keys(queue), id).Int64()
+	return n > 0, err
+}
+
+// Reschedule 修改任务的执行时间, 任务不存在或已完成时返回 false
+// 对正在执行的任务: 执行失败时保留新的执行时间而不是按退避时间重试; 执行成功时任务完成, 新的执行时间不再生效
+func (q *DelayQueue) Reschedule(ctx context.Context, queue, id string, runAt time.Time) (bool, error) {
+	n, err := delayQueueRescheduleScript.Run(ctx, q.redis(), q.keys(queue)[:3], id, runAt.UnixMilli()).Int64()
+	return n > 0, err
+}
+
+// Run 阻塞执行 queue 的任务, ctx 结束后停止取任务, 等待执行中的任务完成后返回
+// 多个实例可同时 Run 同一个队列
+func (q *DelayQueue) Run(ctx context.Context, queue string, handler DelayHandler) error {
+	InfoF("[DelayQueue] %s 开始执行, 并发 %d", queue, q.opt.Concurrency)
+
+	// handler 的 ctx 不随 ctx 立即取消, 停止时给执行中的任务留出 DrainTimeout
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	var (
+		workers sync.WaitGroup
+		poller  sync.WaitGroup
+	)
+	poller.Add(1)
+	go func() {
+		defer poller.Done()
+		q.poll(ctx, queue)
+	}()
+	for i := 0; i < q.opt.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			q.work(ctx, handlerCtx, queue, handler)
+		}()
+	}
+	poller.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(q.opt.DrainTimeout):
+		WarnF("[DelayQueue] %s 等待执行中的任务超时, 取消 handler", queue)
+		cancelHandlers()
+		<-done
+	}
+	InfoF("[DelayQueue] %s 已停止", queue)
+	return nil
+}
+
+// poll 每个间隔把到期任务移到就绪列表
+func (q *DelayQueue) poll(ctx context.Context, queue string) {
+	keys := q.keys(queue)
+	ticker := time.NewTicker(q.opt.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for {
+			n, err := delayQueueMoveScript.Run(ctx, q.redis(), keys[:2], time.Now().UnixMilli(), 100).Int64()
+			if err != nil {
+				if ctx.Err() == nil {
+					ErrorF("[DelayQueue] %s 移动到期任务失败: %v", queue, err)
+				}
+				break
+			}
+			if n < 100 {
+				break
+			}
+		}
+	}
+}
+
+func (q *DelayQueue) work(ctx, handlerCtx context.Context, queue string, handler DelayHandler) {
+	for ctx.Err() == nil {
+		job, err := q.claim(ctx, queue)
+		if err != nil && ctx.Err() == nil {
+			ErrorF("[DelayQueue] %s 获取任务失败: %v", queue, err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.opt.PollInterval):
+			}
+			continue
+		}
+		q.process(handlerCtx, handler, job)
+	}
+}
+
+func (q *DelayQueue) claim(ctx context.Context, queue string) (*DelayJob, error) {
+	leaseUntil := time.Now().Add(q.opt.Visibility).UnixMilli()
+	res, err := delayQueueClaimScript.Run(ctx, q.redis(), q.keys(queue), leaseUntil).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 3 {
+		return nil, nil
+	}
+	return &DelayJob{ID: AnyToString(res[0]), Queue: queue, Payload: AnyToString(res[1]), Attempts: res[2].(int64), lease: leaseUntil}, nil
+}
+
+func (q *DelayQueue) process(ctx context.Context, handler DelayHandler, job *DelayJob) {
+	// 超过租约时间未完成的任务重新到期后会再次取出, 此时执行次数可能已用完
+	var err error
+	if job.Attempts > q.opt.MaxAttempts {
+		err = fmt.Errorf("执行 %d 次未完成", job.Attempts-1)
+	} else {
+		err = q.call(ctx, handler, job)
+	}
+
+	bg, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys := q.keys(job.Queue)
+	if err == nil {
+		_, err = q.redis().TxPipelined(bg, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(bg, keys[0], job.ID)
+			pipe.HDel(bg, keys[2], job.ID)
+			pipe.HDel(bg, keys[3], job.ID)
+			return nil
+		})
+		if err != nil {
+			ErrorF("[DelayQueue] %s 任务 %s 完成后删除失败: %v", job.Queue, job.ID, err)
+		}
+		return
+	}
+
+	if job.Attempts < q.opt.MaxAttempts {
+		WarnF("[DelayQueue] %s 任务 %s 第 %d 次执行失败: %v", job.Queue, job.ID, job.Attempts, err)
+		retryAt := time.Now().Add(delayQueueBackoff(job.Attempts)).UnixMilli()
+		err = delayQueueRetryScript.Run(bg, q.redis(), keys[:1], job.ID, job.lease, retryAt).Err()
+		if err != nil {
+			ErrorF("[DelayQueue] %s 任务 %s 设置重试失败, 租约到期后重试: %v", job.Queue, job.ID, err)
+		}
+		return
+	}
+
+	ErrorF("[DelayQueue] %s 任务 %s 执行 %d 次仍失败, 移入 %s: %v", job.Queue, job.ID, job.Attempts, q.deadKey(job.Queue), err)
+	dead, _ := json.Marshal(map[string]interface{}{
+		"id":       job.ID,
+		"payload":  job.Payload,
+		"attempts": job.Attempts,
+		"error":    err.Error(),
+		"time":     time.Now().Format("2006-01-02 15:04:05"),
+	})
+	_, err = q.redis().TxPipelined(bg, func(pipe redis.Pipeliner) error {
+		pipe.RPush(bg, q.deadKey(job.Queue), dead)
+		pipe.ZRem(bg, keys[0], job.ID)
+		pipe.HDel(bg, keys[2], job.ID)
+		pipe.HDel(bg, keys[3], job.ID)
+		return nil
+	})
+	if err != nil {
+		ErrorF("[DelayQueue] %s 任务 %s 移入死信失败: %v", job.Queue, job.ID, err)
+	}
+}
+
+func (q *DelayQueue) call(ctx context.Context, handler DelayHandler, job *DelayJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// DeadJobs 读取 queue 最近移入死信的 n 个任务, n 小于1时读取全部, 每条为json
+func (q *DelayQueue) DeadJobs(ctx context.Context, queue string, n int64) ([]string, error) {
+	if n < 1 {
+		n = 0
+	}
+	res, err := q.redis().LRange(ctx, q.deadKey(queue), -n, -1).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return res, err
+}
+
+// delayQueueBackoff 第n次执行失败后的重试间隔, 从2秒开始翻倍, 最长10分钟
+func delayQueueBackoff(n int64) time.Duration {
+	if n > 10 {
+		return 10 * time.Minute
+	}
+	d := time.Second << n
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+	return d
+}
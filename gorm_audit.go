@@ -0,0 +1,277 @@
+package dbHelper
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"time"
+)
+
+// ErrStaleObject 乐观锁更新时版本号已变化, 没有行被更新
+var ErrStaleObject = errors.New("stale object: version has changed")
+
+type auditCtxKey int
+
+const (
+	auditOperatorKey auditCtxKey = iota
+	auditTenantKey
+)
+
+// WithOperator 在上下文中设置操作人, 审计插件用于填充 created_by/updated_by
+func WithOperator(ctx context.Context, operator interface{}) context.Context {
+	return context.WithValue(ctx, auditOperatorKey, operator)
+}
+
+// WithTenant 在上下文中设置租户, 审计插件用于填充 tenant_id 并限定查询范围
+func WithTenant(ctx context.Context, tenant interface{}) context.Context {
+	return context.WithValue(ctx, auditTenantKey, tenant)
+}
+
+// AuditModel 审计字段, 嵌入业务模型即可获得审计列、乐观锁与软删除
+type AuditModel struct {
+	CreatedBy string         `gorm:"size:64" json:"created_by"`
+	UpdatedBy string         `gorm:"size:64" json:"updated_by"`
+	TenantID  string         `gorm:"size:64;index" json:"tenant_id"`
+	Version   int64          `gorm:"not null;default:0" json:"version"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at"`
+}
+
+// AuditLog 行变更历史
+type AuditLog struct {
+	ID         int64     `gorm:"primaryKey;autoIncrement" json:"id" bson:"-"`
+	Table      string    `gorm:"column:table_name;size:128;index" json:"table_name" bson:"table_name"`
+	Action     string    `gorm:"size:16" json:"action" bson:"action"` // create update delete
+	PrimaryKey string    `gorm:"size:128;index" json:"primary_key" bson:"primary_key"`
+	Data       string    `gorm:"type:text" json:"data" bson:"data"`
+	Operator   string    `gorm:"size:64" json:"operator" bson:"operator"`
+	TenantID   string    `gorm:"size:64" json:"tenant_id" bson:"tenant_id"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+}
+
+func (AuditLog) TableName() string {
+	return "_audit"
+}
+
+const (
+	auditCreatedBy = "created_by"
+	auditUpdatedBy = "updated_by"
+	auditTenantID  = "tenant_id"
+	auditVersion   = "version"
+	auditLockedKey = "dbHelper:audit:locked"
+)
+
+// AuditPlugin gorm审计插件: 填充审计列, 按租户限定范围, version列乐观锁, 记录行变更历史
+type AuditPlugin struct {
+	conf *AuditConf
+}
+
+var _ gorm.Plugin = (*AuditPlugin)(nil)
+
+func NewAuditPlugin(conf *AuditConf) *AuditPlugin {
+	if conf.MongoCollection == "" {
+		conf.MongoCollection = "_audit"
+	}
+	return &AuditPlugin{conf: conf}
+}
+
+func (p *AuditPlugin) Name() string {
+	return "dbHelper:audit"
+}
+
+func (p *AuditPlugin) Initialize(db *gorm.DB) error {
+	if p.conf.History == "table" {
+		if err := db.AutoMigrate(&AuditLog{}); err != nil {
+			return err
+		}
+	}
+
+	cb := db.Callback()
+	if err := cb.Create().Before("gorm:create").Register("dbHelper:audit_before_create", p.beforeCreate); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("dbHelper:audit_before_update", p.beforeUpdate); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("dbHelper:audit_after_update", p.afterUpdate); err != nil {
+		return err
+	}
+	if err := cb.Create().After("gorm:create").Register("dbHelper:audit_after_create", p.history("create")); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:delete").Register("dbHelper:audit_after_delete", p.history("delete")); err != nil {
+		return err
+	}
+	if p.conf.Tenant {
+		if err := cb.Query().Before("gorm:query").Register("dbHelper:audit_tenant_query", p.tenantScope); err != nil {
+			return err
+		}
+		if err := cb.Delete().Before("gorm:delete").Register("dbHelper:audit_tenant_delete", p.tenantScope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *AuditPlugin) skip(db *gorm.DB) bool {
+	return db.Error != nil || db.Statement.Schema == nil ||
+		db.Statement.Table == AuditLog{}.TableName() || db.Statement.Table == OutboxMessage{}.TableName()
+}
+
+func (p *AuditPlugin) beforeCreate(db *gorm.DB) {
+	if p.skip(db) {
+		return
+	}
+	ctx := db.Statement.Context
+	operator := ctx.Value(auditOperatorKey)
+	tenant := ctx.Value(auditTenantKey)
+
+	fill := func(rv reflect.Value) {
+		if operator != nil {
+			auditSetIfZero(db, rv, auditCreatedBy, operator)
+			auditSetIfZero(db, rv, auditUpdatedBy, operator)
+		}
+		if tenant != nil {
+			auditSetIfZero(db, rv, auditTenantID, tenant)
+		}
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fill(reflect.Indirect(rv.Index(i)))
+		}
+	case reflect.Struct:
+		fill(rv)
+	}
+}
+
+func (p *AuditPlugin) beforeUpdate(db *gorm.DB) {
+	if p.skip(db) {
+		return
+	}
+	stmt := db.Statement
+
+	if operator := stmt.Context.Value(auditOperatorKey); operator != nil && stmt.Schema.LookUpField(auditUpdatedBy) != nil {
+		stmt.SetColumn(auditUpdatedBy, auditValue(stmt.Schema.LookUpField(auditUpdatedBy), operator), true)
+	}
+	if p.conf.Tenant {
+		p.tenantScope(db)
+	}
+
+	// 乐观锁: 只对带主键的单个对象生效, 以当前对象的版本号为条件, 更新后版本号加一
+	field := stmt.Schema.LookUpField(auditVersion)
+	pk := stmt.Schema.PrioritizedPrimaryField
+	if field == nil || pk == nil || stmt.ReflectValue.Kind() != reflect.Struct {
+		return
+	}
+	if _, zero := pk.ValueOf(stmt.Context, stmt.ReflectValue); zero {
+		return
+	}
+	if m, ok := stmt.Dest.(map[string]interface{}); ok {
+		if _, ok = m[auditVersion]; ok {
+			return
+		}
+	}
+	value, _ := field.ValueOf(stmt.Context, stmt.ReflectValue)
+	version, ok := anyIntValue(value)
+	if !ok {
+		return
+	}
+	stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: version},
+	}})
+	stmt.SetColumn(auditVersion, version+1, true)
+	db.InstanceSet(auditLockedKey, true)
+}
+
+func (p *AuditPlugin) afterUpdate(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	if _, ok := db.InstanceGet(auditLockedKey); ok && db.RowsAffected == 0 && !db.DryRun {
+		_ = db.AddError(ErrStaleObject)
+		return
+	}
+	p.history("update")(db)
+}
+
+// tenantScope 上下文中有租户时, 为带 tenant_id 列的模型追加租户条件
+func (p *AuditPlugin) tenantScope(db *gorm.DB) {
+	if p.skip(db) {
+		return
+	}
+	tenant := db.Statement.Context.Value(auditTenantKey)
+	field := db.Statement.Schema.LookUpField(auditTenantID)
+	if tenant == nil || field == nil {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenant},
+	}})
+}
+
+// history 记录行变更历史到 _audit 表或mongo集合
+func (p *AuditPlugin) history(action string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		if p.conf.History == "" || p.skip(db) || db.RowsAffected == 0 || db.DryRun {
+			return
+		}
+		stmt := db.Statement
+		ctx := stmt.Context
+
+		data := stmt.Dest
+		if data == nil {
+			data = stmt.Model
+		}
+		dataJson, _ := AnyToJson(data)
+		log := &AuditLog{
+			Table:     stmt.Table,
+			Action:    action,
+			Data:      dataJson,
+			Operator:  AnyToString(ctx.Value(auditOperatorKey)),
+			TenantID:  AnyToString(ctx.Value(auditTenantKey)),
+			CreatedAt: time.Now(),
+		}
+		if pk := stmt.Schema.PrioritizedPrimaryField; pk != nil && stmt.ReflectValue.Kind() == reflect.Struct {
+			v, _ := pk.ValueOf(ctx, stmt.ReflectValue)
+			log.PrimaryKey = AnyToString(v)
+		}
+
+		var err error
+		switch p.conf.History {
+		case "table":
+			// 使用同一个连接, 在事务中时与业务数据一起提交
+			err = db.Session(&gorm.Session{NewDB: true}).Create(log).Error
+		case "mongo":
+			_, err = GetMongoDBConn(p.conf.MongoTag).Collection(p.conf.MongoCollection).InsertOne(ctx, log)
+		}
+		if err != nil {
+			ErrorF("[Audit] 记录变更历史失败 table = %s err = %v", stmt.Table, err)
+		}
+	}
+}
+
+func auditSetIfZero(db *gorm.DB, rv reflect.Value, name string, value interface{}) {
+	field := db.Statement.Schema.LookUpField(name)
+	if field == nil {
+		return
+	}
+	if _, zero := field.ValueOf(db.Statement.Context, rv); !zero {
+		return
+	}
+	if err := field.Set(db.Statement.Context, rv, auditValue(field, value)); err != nil {
+		ErrorF("[Audit] 填充 %s 失败: %v", name, err)
+	}
+}
+
+// auditValue 字符串类型的审计列统一转换为字符串
+func auditValue(field *schema.Field, value interface{}) interface{} {
+	if field.FieldType.Kind() == reflect.String {
+		return AnyToString(value)
+	}
+	return value
+}
@@ -0,0 +1,305 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const queryCacheTTLKey = "dbHelper:cache_ttl"
+
+// Cache 查询结果缓存, 用法 db.Scopes(dbHelper.Cache(time.Minute)).Find(&list)
+// 需要在mysql配置中开启 cache, 只对 Find/First/Take/Last 以及 Raw(...).Find 等查询生效, 结果以json序列化保存
+func Cache(ttl time.Duration) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Set(queryCacheTTLKey, ttl)
+	}
+}
+
+var queryCachePlugins = make(map[string]*QueryCachePlugin)
+
+// GetQueryCacheStats 获取mysql标记的查询缓存命中与未命中次数, 等待其他请求查询数据库的并发请求计为未命中
+func GetQueryCacheStats(tag string) (hits, misses int64) {
+	p, ok := queryCachePlugins[tag]
+	if !ok {
+		return 0, 0
+	}
+	return p.hits.Load(), p.misses.Load()
+}
+
+// QueryCachePlugin gorm查询缓存插件, 缓存保存在redis标记的连接中
+// 缓存key按sql中出现的每个表记录在集合 {prefix}:table:{table} 中, 对其中任一表的写入会删除这些缓存
+type QueryCachePlugin struct {
+	conf   *QueryCacheConf
+	group  singleflight.Group
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+var _ gorm.Plugin = (*QueryCachePlugin)(nil)
+
+func NewQueryCachePlugin(conf *QueryCacheConf) *QueryCachePlugin {
+	if conf.Prefix == "" {
+		conf.Prefix = "dbHelper:cache"
+	}
+	return &QueryCachePlugin{conf: conf}
+}
+
+func (p *QueryCachePlugin) Name() string {
+	return "dbHelper:cache"
+}
+
+// Initialize 写入的清除在默认事务提交之后执行, 避免提交前其他请求读到旧数据并重新写入缓存
+func (p *QueryCachePlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Query().Replace("gorm:query", p.query); err != nil {
+		return err
+	}
+	if err := cb.Create().After("gorm:commit_or_rollback_transaction").Register("dbHelper:cache_invalidate_create", p.invalidate); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:commit_or_rollback_transaction").Register("dbHelper:cache_invalidate_update", p.invalidate); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:commit_or_rollback_transaction").Register("dbHelper:cache_invalidate_delete", p.invalidate); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("dbHelper:cache_invalidate_raw", p.invalidate)
+}
+
+// redis 使用时再获取连接, 初始化mysql时redis可能尚未初始化
+func (p *QueryCachePlugin) redis() redis.UniversalClient {
+	return GetRedisConn(p.conf.RedisTag)
+}
+
+func (p *QueryCachePlugin) tableKey(table string) string {
+	return p.conf.Prefix + ":table:" + table
+}
+
+// queryCacheTagScript 把缓存key加入表的集合, 集合的过期时间不短于其中任何缓存
+var queryCacheTagScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+type queryCacheResult struct {
+	data   []byte
+	cached bool
+}
+
+func (p *QueryCachePlugin) query(db *gorm.DB) {
+	v, ok := db.Get(queryCacheTTLKey)
+	ttl, _ := v.(time.Duration)
+	if db.Error != nil || !ok || ttl <= 0 {
+		callbacks.Query(db)
+		return
+	}
+
+	callbacks.BuildQuerySQL(db)
+	if db.Error != nil || db.DryRun {
+		return
+	}
+
+	stmt := db.Statement
+	ctx := stmt.Context
+	// 无法从sql中识别出表时不缓存, 否则写入后无法清除
+	tables := queryCacheTables(stmt.Table, stmt.SQL.String())
+	if len(tables) == 0 {
+		callbacks.Query(db)
+		return
+	}
+	key := p.conf.Prefix + ":" + tables[0] + ":" + MD5(db.Dialector.Explain(stmt.SQL.String(), stmt.Vars...))
+
+	// 同一个key并发查询时只有一个请求访问redis和数据库, 其余请求共享结果
+	executed := false
+	res, err, _ := p.group.Do(key, func() (interface{}, error) {
+		b, err := p.redis().Get(ctx, key).Bytes()
+		if err == nil {
+			return &queryCacheResult{data: b, cached: true}, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			WarnF("[QueryCache] 读取缓存失败 key = %s err = %v", key, err)
+		}
+
+		executed = true
+		callbacks.Query(db)
+		if db.Error != nil {
+			return nil, db.Error
+		}
+		b, err = json.Marshal(stmt.Dest)
+		if err != nil {
+			return nil, err
+		}
+
+		pipe := p.redis().Pipeline()
+		pipe.Set(ctx, key, b, ttl)
+		for _, table := range tables {
+			queryCacheTagScript.Eval(ctx, pipe, []string{p.tableKey(table)}, key, ttl.Milliseconds())
+		}
+		if _, err = pipe.Exec(ctx); err != nil {
+			WarnF("[QueryCache] 写入缓存失败 key = %s err = %v", key, err)
+		}
+		return &queryCacheResult{data: b}, nil
+	})
+
+	if executed {
+		p.misses.Add(1)
+		return
+	}
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	r := res.(*queryCacheResult)
+	if r.cached {
+		p.hits.Add(1)
+	} else {
+		p.misses.Add(1)
+	}
+	if err = json.Unmarshal(r.data, stmt.Dest); err != nil {
+		_ = db.AddError(err)
+		return
+	}
+
+	rv := reflect.Indirect(reflect.ValueOf(stmt.Dest))
+	if rv.Kind() == reflect.Slice {
+		db.RowsAffected = int64(rv.Len())
+	} else {
+		db.RowsAffected = 1
+	}
+}
+
+// invalidate 写入成功后删除涉及的表的全部查询缓存
+// 在 CacheTransaction 中的写入记录下来, 提交后再删除; 在其他显式事务中的写入立即删除, 并在1秒后再删除一次
+func (p *QueryCachePlugin) invalidate(db *gorm.DB) {
+	if db.Error != nil || db.DryRun {
+		return
+	}
+	stmt := db.Statement
+	if stmt.SQL.Len() == 0 || (db.RowsAffected == 0 && stmt.Table != "") {
+		return
+	}
+	tables := queryCacheTables(stmt.Table, stmt.SQL.String())
+	if len(tables) == 0 {
+		return
+	}
+
+	ctx := stmt.Context
+	if pending, ok := ctx.Value(cacheTxKey{}).(*cacheTxTables); ok {
+		pending.add(p, tables)
+		return
+	}
+	p.invalidateTables(ctx, tables)
+	if committer, ok := stmt.ConnPool.(gorm.TxCommitter); ok && committer != nil {
+		time.AfterFunc(time.Second, func() {
+			p.invalidateTables(context.Background(), tables)
+		})
+	}
+}
+
+func (p *QueryCachePlugin) invalidateTables(ctx context.Context, tables []string) {
+	rdb := p.redis()
+	for _, table := range tables {
+		tableKey := p.tableKey(table)
+		for {
+			keys, err := rdb.SPopN(ctx, tableKey, 500).Result()
+			if err != nil {
+				ErrorF("[QueryCache] 清除缓存失败 table = %s err = %v", table, err)
+				break
+			}
+			if len(keys) == 0 {
+				break
+			}
+			pipe := rdb.Pipeline()
+			for _, k := range keys {
+				pipe.Del(ctx, k)
+			}
+			if _, err = pipe.Exec(ctx); err != nil {
+				ErrorF("[QueryCache] 清除缓存失败 table = %s err = %v", table, err)
+				break
+			}
+		}
+	}
+}
+
+type cacheTxKey struct{}
+
+// cacheTxTables CacheTransaction 中写入过的表, 提交后清除
+type cacheTxTables struct {
+	mu     sync.Mutex
+	tables map[*QueryCachePlugin][]string
+}
+
+func (t *cacheTxTables) add(p *QueryCachePlugin, tables []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, table := range tables {
+		if !SliceContains(t.tables[p], table) {
+			t.tables[p] = append(t.tables[p], table)
+		}
+	}
+}
+
+// CacheTransaction 与 db.Transaction 相同, 事务中写入的表的查询缓存在提交成功后清除
+// 直接使用 db.Transaction 时缓存在写入时清除, 提交前其他请求可能把旧数据重新写入缓存, 插件会在1秒后再清除一次
+func CacheTransaction(db *gorm.DB, fc func(tx *gorm.DB) error, opts ...*sql.TxOptions) error {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// 嵌套调用由最外层提交后清除
+	if _, ok := ctx.Value(cacheTxKey{}).(*cacheTxTables); ok {
+		return db.Transaction(fc, opts...)
+	}
+
+	pending := &cacheTxTables{tables: make(map[*QueryCachePlugin][]string)}
+	err := db.WithContext(context.WithValue(ctx, cacheTxKey{}, pending)).Transaction(fc, opts...)
+	if err != nil {
+		return err
+	}
+	for p, tables := range pending.tables {
+		p.invalidateTables(ctx, tables)
+	}
+	return nil
+}
+
+var queryCacheTableRe = regexp.MustCompile("(?i)\\b(?:FROM|JOIN|UPDATE|INTO|(?:TRUNCATE|ALTER|DROP)\\s+TABLE|TRUNCATE)\\s+" +
+	"([`\"\\w.]+(?:\\s+(?:AS\\s+)?\\w+)?(?:\\s*,\\s*[`\"\\w.]+(?:\\s+(?:AS\\s+)?\\w+)?)*)")
+
+// queryCacheTables sql中 FROM/JOIN/UPDATE/INTO 等之后的表名(包括子查询与逗号连接的表), 去掉库名与引号并转为小写
+// 可能多识别出一些名称(如 EXTRACT(YEAR FROM col) 中的列名), 只会多清除缓存
+func queryCacheTables(table, query string) []string {
+	tables := make([]string, 0, 2)
+	add := func(name string) {
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		}
+		name = strings.ToLower(strings.Trim(name, "`\""))
+		if name != "" && !SliceContains(tables, name) {
+			tables = append(tables, name)
+		}
+	}
+	add(table)
+	for _, m := range queryCacheTableRe.FindAllStringSubmatch(query, -1) {
+		for _, item := range strings.Split(m[1], ",") {
+			if fields := strings.Fields(item); len(fields) > 0 {
+				add(fields[0])
+			}
+		}
+	}
+	return tables
+}
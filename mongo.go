@@ -43,6 +43,7 @@ func mongoDBConn(conf *MongoDBConf) (*mongo.Database, error) {
 			User:       conf.SSHUsername,
 			Password:   conf.SSHPassword,
 			PrivateKey: conf.SSHPrivateKey,
+			Passphrase: conf.SSHPassphrase,
 			RemoteHost: conf.SSHRemoteHost,
 			RemotePort: conf.SSHRemotePort,
 			TargetHost: conf.Host,
@@ -45,6 +45,7 @@ func mysqlConn(conf *MysqlConf) (*gorm.DB, error) {
 			User:       conf.SSHUsername,
 			Password:   conf.SSHPassword,
 			PrivateKey: conf.SSHPrivateKey,
+			Passphrase: conf.SSHPassphrase,
 			RemoteHost: conf.SSHRemoteHost,
 			RemotePort: conf.SSHRemotePort,
 			TargetHost: conf.Host,
@@ -80,16 +81,33 @@ func mysqlConn(conf *MysqlConf) (*gorm.DB, error) {
 		str = str + "&interpolateParams=true"
 	}
 
-	orm, err = gorm.Open(mysql.Open(str), &gorm.Config{
-		NamingStrategy: schema.NamingStrategy{
-			SingularTable: true,
-		},
-		Logger: NewGormLogger(),
-	})
+	orm, err = gorm.Open(mysql.Open(str), newGormConfig())
 	if err != nil {
 		return nil, err
 	}
 
+	if conf.Audit != nil && conf.Audit.Enable {
+		if err = orm.Use(NewAuditPlugin(conf.Audit)); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Cache != nil && conf.Cache.RedisTag != "" {
+		cachePlugin := NewQueryCachePlugin(conf.Cache)
+		if err = orm.Use(cachePlugin); err != nil {
+			return nil, err
+		}
+		queryCachePlugins[conf.Tag] = cachePlugin
+	}
+
+	if conf.Outbox != nil {
+		outbox, err := newOutbox(orm, conf.Outbox)
+		if err != nil {
+			return nil, err
+		}
+		outboxes[conf.Tag] = outbox
+	}
+
 	db, err := orm.DB()
 	if err != nil {
 		return nil, err
@@ -116,6 +134,16 @@ func mysqlConn(conf *MysqlConf) (*gorm.DB, error) {
 	return orm, err
 }
 
+// newGormConfig mysql 与 pgsql 共用的 gorm 配置
+func newGormConfig() *gorm.Config {
+	return &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{
+			SingularTable: true,
+		},
+		Logger: NewGormLogger(),
+	}
+}
+
 type GormLogger struct {
 	SlowThreshold time.Duration
 	//Level         gormLogger.LogLevel
@@ -137,13 +165,13 @@ func (l *GormLogger) LogMode(lev gormLogger.LogLevel) gormLogger.Interface {
 	}
 }
 func (l *GormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
-	InfoF(msg, data)
+	InfoF(msg, data...)
 }
 func (l *GormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
-	WarnF(msg, data)
+	WarnF(msg, data...)
 }
 func (l *GormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
-	ErrorF(msg, data)
+	ErrorF(msg, data...)
 }
 func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
 	elapsed := time.Since(begin)
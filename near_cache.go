@@ -0,0 +1,327 @@
+package dbHelper
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NearCacheOptions 二级缓存参数
+type NearCacheOptions struct {
+	Redis    *RedisCacheOptions // redis 层参数, 见 RedisCacheOptions
+	Size     int                // 本地最多缓存条数, 超出时淘汰最久未使用的 默认10000
+	LocalTTL time.Duration      // 本地缓存时间 默认1分钟
+	Channel  string             // 失效广播的 pub/sub 频道 默认 {prefix}:near:invalidate
+	StaleTTL time.Duration      // pub/sub 断开期间只使用写入本地不超过此时间的缓存 默认5秒, 没有报错的断开最迟10秒内发现
+}
+
+// NearCacheStats 各层的命中统计
+type NearCacheStats struct {
+	LocalHits    int64
+	LocalMisses  int64
+	RemoteHits   int64
+	RemoteMisses int64
+	Size         int  // 本地缓存条数
+	Connected    bool // 失效广播是否正常订阅
+}
+
+type nearEntry[T any] struct {
+	key      string
+	value    T
+	notFound bool
+	storedAt time.Time
+	expireAt time.Time
+}
+
+// NearCache 进程内 LRU 与 redis 组成的二级缓存, 写入与删除通过 pub/sub 广播, 各实例删除本地的同一个key
+// pub/sub 断开时本地缓存最多使用 StaleTTL, 重新订阅后清空本地缓存
+type NearCache[T any] struct {
+	remote *RedisCache[T]
+	opt    NearCacheOptions
+	id     string
+
+	mux   sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+
+	connected    atomic.Bool
+	localHits    atomic.Int64
+	localMisses  atomic.Int64
+	remoteHits   atomic.Int64
+	remoteMisses atomic.Int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewNearCache 在redis标记上创建二级缓存并订阅失效广播, 不再使用时调用 Close
+func NewNearCache[T any](tag string, opt *NearCacheOptions) *NearCache[T] {
+	c := &NearCache[T]{lru: list.New(), items: make(map[string]*list.Element), id: GetUUID(), done: make(chan struct{})}
+	if opt != nil {
+		c.opt = *opt
+	}
+	c.remote = NewRedisCache[T](tag, c.opt.Redis)
+	if c.opt.Size < 1 {
+		c.opt.Size = 10000
+	}
+	if c.opt.LocalTTL <= 0 {
+		c.opt.LocalTTL = time.Minute
+	}
+	if c.opt.StaleTTL <= 0 {
+		c.opt.StaleTTL = 5 * time.Second
+	}
+	if c.opt.Channel == "" {
+		c.opt.Channel = c.remote.key("near:invalidate")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.subscribe(ctx)
+	return c
+}
+
+// Get 依次读取本地与redis, 不存在返回 ErrCacheMiss, 缓存了数据不存在时返回 ErrCacheNotFound
+func (c *NearCache[T]) Get(ctx context.Context, key string) (T, error) {
+	if v, notFound, ok := c.getLocal(key); ok {
+		if notFound {
+			return v, ErrCacheNotFound
+		}
+		return v, nil
+	}
+
+	v, err := c.remote.Get(ctx, key)
+	c.afterRemote(key, v, err)
+	return v, err
+}
+
+// GetOrLoad 依次读取本地与redis, 都未命中时调用 loader 加载并写入两层缓存, 见 RedisCache.GetOrLoad
+func (c *NearCache[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	v, err := c.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrCacheNotFound) {
+		return v, err
+	}
+	if !errors.Is(err, ErrCacheMiss) {
+		WarnF("[NearCache] 读取缓存失败 key = %s err = %v", key, err)
+	}
+
+	v, err = c.remote.load(ctx, key, ttl, loader)
+	if err == nil || errors.Is(err, ErrCacheNotFound) {
+		c.setLocal(key, v, err != nil)
+	}
+	return v, err
+}
+
+// Set 写入redis并通知其他实例删除本地缓存
+func (c *NearCache[T]) Set(ctx context.Context, key string, value T, ttl time.Duration) error {
+	if err := c.remote.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	c.setLocal(key, value, false)
+	return c.publish(ctx, key)
+}
+
+// Delete 删除redis与各实例的本地缓存
+func (c *NearCache[T]) Delete(ctx context.Context, keys ...string) error {
+	if err := c.remote.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		c.deleteLocal(k)
+	}
+	return c.publish(ctx, keys...)
+}
+
+// Stats 本地与redis两层的命中统计
+func (c *NearCache[T]) Stats() NearCacheStats {
+	c.mux.Lock()
+	size := c.lru.Len()
+	c.mux.Unlock()
+	return NearCacheStats{
+		LocalHits:    c.localHits.Load(),
+		LocalMisses:  c.localMisses.Load(),
+		RemoteHits:   c.remoteHits.Load(),
+		RemoteMisses: c.remoteMisses.Load(),
+		Size:         size,
+		Connected:    c.connected.Load(),
+	}
+}
+
+// Close 停止订阅失效广播
+func (c *NearCache[T]) Close() {
+	c.cancel()
+	<-c.done
+}
+
+func (c *NearCache[T]) afterRemote(key string, v T, err error) {
+	switch {
+	case err == nil:
+		c.remoteHits.Add(1)
+		c.setLocal(key, v, false)
+	case errors.Is(err, ErrCacheNotFound):
+		c.remoteHits.Add(1)
+		c.setLocal(key, v, true)
+	default:
+		c.remoteMisses.Add(1)
+	}
+}
+
+func (c *NearCache[T]) getLocal(key string) (T, bool, bool) {
+	var zero T
+	now := time.Now()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.localMisses.Add(1)
+		return zero, false, false
+	}
+	e := el.Value.(*nearEntry[T])
+	// 订阅断开期间可能漏掉失效通知, 只信任最近写入的缓存
+	stale := !c.connected.Load() && now.Sub(e.storedAt) > c.opt.StaleTTL
+	if now.After(e.expireAt) || stale {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		c.localMisses.Add(1)
+		return zero, false, false
+	}
+	c.lru.MoveToFront(el)
+	c.localHits.Add(1)
+	return e.value, e.notFound, true
+}
+
+func (c *NearCache[T]) setLocal(key string, v T, notFound bool) {
+	now := time.Now()
+	e := &nearEntry[T]{key: key, value: v, notFound: notFound, storedAt: now, expireAt: now.Add(c.opt.LocalTTL)}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opt.Size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.items, last.Value.(*nearEntry[T]).key)
+	}
+}
+
+func (c *NearCache[T]) deleteLocal(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *NearCache[T]) clearLocal() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// publish 广播失效消息, 内容为 {实例id}|{key}, 收到自己发出的消息时忽略
+func (c *NearCache[T]) publish(ctx context.Context, keys ...string) error {
+	pipe := c.remote.redis().Pipeline()
+	for _, k := range keys {
+		pipe.Publish(ctx, c.opt.Channel, c.id+"|"+k)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// 失效广播的订阅连接每隔 nearCachePing 发送一次 PING, 超过两个间隔没有收到任何回复时认为连接已断开
+const nearCachePing = 5 * time.Second
+
+// subscribe 订阅失效广播, 断开后关闭订阅连接, 1秒后重新订阅
+func (c *NearCache[T]) subscribe(ctx context.Context) {
+	defer close(c.done)
+	for {
+		err := c.subscribeOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if c.connected.Swap(false) {
+			WarnF("[NearCache] 失效广播订阅断开, 本地缓存最多使用 %v: %v", c.opt.StaleTTL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// subscribeOnce 在一个订阅连接上读取失效广播, 返回连接断开的原因
+// 读取不设置超时, ssh隧道的连接不支持 SetDeadline; 由另一个协程定期 PING, 长时间没有回复或 ctx 结束时关闭连接打断读取
+func (c *NearCache[T]) subscribeOnce(ctx context.Context) error {
+	ps := c.remote.redis().Subscribe(ctx)
+	defer func() {
+		_ = ps.Close()
+	}()
+	if err := ps.Subscribe(ctx, c.opt.Channel); err != nil {
+		return err
+	}
+
+	var (
+		lastReply atomic.Int64
+		timedOut  atomic.Bool
+	)
+	lastReply.Store(time.Now().UnixNano())
+	pingCtx, stopPing := context.WithCancel(ctx)
+	defer stopPing()
+	go func() {
+		ticker := time.NewTicker(nearCachePing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingCtx.Done():
+				_ = ps.Close()
+				return
+			case <-ticker.C:
+			}
+			if time.Since(time.Unix(0, lastReply.Load())) > 2*nearCachePing {
+				timedOut.Store(true)
+				_ = ps.Close()
+				return
+			}
+			_ = ps.Ping(pingCtx)
+		}
+	}()
+
+	for {
+		msg, err := ps.ReceiveTimeout(ctx, -1)
+		if err != nil {
+			if timedOut.Load() {
+				return fmt.Errorf("%v 内未收到 PING 的回复", 2*nearCachePing)
+			}
+			return err
+		}
+		lastReply.Store(time.Now().UnixNano())
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" && !c.connected.Swap(true) {
+				// 断开期间的失效通知已丢失
+				c.clearLocal()
+				InfoF("[NearCache] 已订阅失效广播 %s", c.opt.Channel)
+			}
+		case *redis.Message:
+			id, key, ok := strings.Cut(m.Payload, "|")
+			if ok && id != c.id {
+				c.deleteLocal(key)
+			}
+		}
+	}
+}
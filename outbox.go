@@ -0,0 +1,298 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormLogger "gorm.io/gorm/logger"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	outboxPending = 0 // 待发送
+	outboxSent    = 1 // 已发送
+	outboxDead    = 2 // 超过重试次数, 不再发送
+)
+
+// OutboxMessage 发件箱消息, 与业务数据在同一个事务中写入, 由 relay 发布到 redis stream
+type OutboxMessage struct {
+	ID        int64      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Topic     string     `gorm:"size:255;not null" json:"topic"`
+	Payload   string     `gorm:"type:mediumtext" json:"payload"`
+	Status    int        `gorm:"not null;default:0;index:idx_outbox_pending,priority:1" json:"status"` // 0:待发送 1:已发送 2:超过重试次数
+	NextAt    time.Time  `gorm:"index:idx_outbox_pending,priority:2" json:"next_at"`                   // 下次发送时间
+	Attempts  int        `gorm:"not null;default:0" json:"attempts"`
+	LastError string     `gorm:"size:1024" json:"last_error"`
+	CreatedAt time.Time  `json:"created_at"`
+	SentAt    *time.Time `json:"sent_at"`
+}
+
+func (OutboxMessage) TableName() string {
+	return "_outbox"
+}
+
+var outboxes = make(map[string]*Outbox)
+
+// GetOutbox 获取mysql标记的发件箱, 需要在mysql配置中开启 outbox
+func GetOutbox(tag string) *Outbox {
+	o, ok := outboxes[tag]
+	if !ok {
+		panic("[Outbox] 未init")
+	}
+	return o
+}
+
+// Outbox 事务发件箱, 消息随业务事务提交, relay 轮询 _outbox 表发布到 redis stream {prefix}{topic}
+// relay 使用 FOR UPDATE SKIP LOCKED (mysql 8.0+) 认领消息, 多实例可同时运行; 投递语义为至少一次, 消费者应按 id 去重
+// 不保证同一 topic 的顺序: 发布失败的消息在退避后重试, 此时之后写入的消息可能已经发布, 多实例时各批次也会并发发布, 需要顺序的消费者应按 id 判断
+type Outbox struct {
+	conf    *OutboxConf
+	db      *gorm.DB
+	sent    atomic.Int64
+	retries atomic.Int64
+}
+
+func newOutbox(orm *gorm.DB, conf *OutboxConf) (*Outbox, error) {
+	if conf.Interval < 1 {
+		conf.Interval = 1000
+	}
+	if conf.BatchSize < 1 {
+		conf.BatchSize = 100
+	}
+	if conf.MaxRetry < 1 {
+		conf.MaxRetry = 10
+	}
+	if conf.KeepSent == 0 {
+		conf.KeepSent = 72
+	}
+	if err := orm.AutoMigrate(&OutboxMessage{}); err != nil {
+		return nil, err
+	}
+	// relay 每个间隔都会轮询, 不输出sql日志, 出错时单独输出
+	db := orm.Session(&gorm.Session{NewDB: true, Logger: gormLogger.Discard})
+	return &Outbox{conf: conf, db: db}, nil
+}
+
+// startOutboxRelays 启动配置了redis标记的发件箱 relay, 需在redis初始化之后调用
+func startOutboxRelays() {
+	for tag, o := range outboxes {
+		if o.conf.RedisTag == "" {
+			continue
+		}
+		InfoF("[Outbox] %s relay 已启动, 发布到redis %s", tag, o.conf.RedisTag)
+		go o.relay()
+	}
+}
+
+// Add 在调用方的事务 tx 中写入一条消息, payload 为 string/[]byte 时原样保存, 其余类型序列化为json
+func (o *Outbox) Add(tx *gorm.DB, topic string, payload interface{}) error {
+	var data string
+	switch v := payload.(type) {
+	case string:
+		data = v
+	case []byte:
+		data = string(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+	return tx.Create(&OutboxMessage{Topic: topic, Payload: data, NextAt: time.Now()}).Error
+}
+
+// OutboxStats 发件箱积压情况
+type OutboxStats struct {
+	Pending   int64         // 待发送条数
+	Dead      int64         // 超过重试次数不再发送的条数
+	OldestAge time.Duration // 最早一条待发送消息已等待的时间
+	Sent      int64         // 本进程发布成功的条数
+	Retries   int64         // 本进程发布失败的次数
+}
+
+func (o *Outbox) Stats(ctx context.Context) (*OutboxStats, error) {
+	var (
+		stats  = &OutboxStats{Sent: o.sent.Load(), Retries: o.retries.Load()}
+		oldest sql.NullTime
+	)
+	err := o.db.WithContext(ctx).Raw(fmt.Sprintf("SELECT COUNT(CASE WHEN status = %d THEN 1 END), COUNT(CASE WHEN status = %d THEN 1 END), "+
+		"MIN(CASE WHEN status = %d THEN created_at END) FROM `_outbox` WHERE status <> %d", outboxPending, outboxDead, outboxPending, outboxSent)).
+		Row().Scan(&stats.Pending, &stats.Dead, &oldest)
+	if err != nil {
+		return nil, err
+	}
+	if oldest.Valid {
+		stats.OldestAge = time.Since(oldest.Time)
+	}
+	return stats, nil
+}
+
+func (o *Outbox) relay() {
+	ticker := time.NewTicker(time.Duration(o.conf.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	for range ticker.C {
+		ctx := context.Background()
+		for {
+			n, err := o.publish(ctx)
+			if err != nil {
+				ErrorF("[Outbox] 发布失败: %v", err)
+				break
+			}
+			if n < o.conf.BatchSize {
+				break
+			}
+		}
+
+		if o.conf.KeepSent > 0 && time.Since(lastCleanup) > 10*time.Minute {
+			lastCleanup = time.Now()
+			o.cleanup(ctx)
+		}
+	}
+}
+
+// outboxLease relay 认领消息后的租约, 租约内其他 relay 不会取到这些消息, 进程在发布中途退出时租约到期后重新发布
+const outboxLease = 30 * time.Second
+
+// publish 认领一批到期的待发送消息并发布, 返回本批条数; redis 连接失败时返回错误, 本轮不再继续
+func (o *Outbox) publish(ctx context.Context) (int, error) {
+	list, err := o.claim(ctx)
+	if err != nil || len(list) == 0 {
+		return 0, err
+	}
+
+	pipe := GetRedisConn(o.conf.RedisTag).Pipeline()
+	cmds := make([]*redis.StringCmd, len(list))
+	for i, m := range list {
+		cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: o.conf.Prefix + m.Topic,
+			MaxLen: o.conf.MaxLen,
+			Approx: o.conf.MaxLen > 0,
+			Values: map[string]interface{}{"id": m.ID, "topic": m.Topic, "payload": m.Payload},
+		})
+	}
+	// 逐条检查结果, 部分失败时其余消息照常标记为已发送
+	_, _ = pipe.Exec(ctx)
+
+	var transportErr error
+	now := time.Now()
+	sent := make([]int64, 0, len(list))
+	for i, m := range list {
+		pubErr := cmds[i].Err()
+		if pubErr == nil {
+			sent = append(sent, m.ID)
+			continue
+		}
+		o.retries.Add(1)
+		if !o.isReplyError(pubErr) {
+			transportErr = pubErr
+		}
+		if err = o.fail(ctx, m, pubErr, now); err != nil {
+			return len(list), err
+		}
+	}
+
+	if len(sent) > 0 {
+		err = o.db.WithContext(ctx).Model(&OutboxMessage{}).Where("id IN ?", sent).
+			Updates(map[string]interface{}{"status": outboxSent, "sent_at": now}).Error
+		if err != nil {
+			return len(list), err
+		}
+	}
+	o.sent.Add(int64(len(sent)))
+	return len(list), transportErr
+}
+
+// claim 在短事务中锁定一批到期的待发送消息, 将 next_at 推迟一个租约后提交, 发布 redis 期间不持有行锁
+func (o *Outbox) claim(ctx context.Context) ([]*OutboxMessage, error) {
+	var list []*OutboxMessage
+	err := o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate, Options: clause.LockingOptionsSkipLocked}).
+			Where("status = ? AND next_at <= ?", outboxPending, now).
+			Order("id").Limit(o.conf.BatchSize).Find(&list).Error
+		if err != nil || len(list) == 0 {
+			return err
+		}
+		ids := make([]int64, len(list))
+		for i, m := range list {
+			ids[i] = m.ID
+		}
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).Update("next_at", now.Add(outboxLease)).Error
+	})
+	return list, err
+}
+
+// isReplyError redis 返回的错误(如 OOM、WRONGTYPE), 其余为连接失败、超时等传输错误
+func (o *Outbox) isReplyError(err error) bool {
+	var replyErr redis.Error
+	return errors.As(err, &replyErr)
+}
+
+// fail 记录发布失败; redis 返回的错误计入重试次数并指数退避, 传输错误不计入, 在下一个轮询间隔后重试
+func (o *Outbox) fail(ctx context.Context, m *OutboxMessage, err error, now time.Time) error {
+	lastError := []rune(err.Error())
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+	updates := map[string]interface{}{
+		"next_at":    now.Add(time.Duration(o.conf.Interval) * time.Millisecond),
+		"last_error": string(lastError),
+	}
+	if o.isReplyError(err) {
+		m.Attempts++
+		status := outboxPending
+		if m.Attempts >= o.conf.MaxRetry {
+			status = outboxDead
+			ErrorF("[Outbox] 消息 %d 重试 %d 次仍失败, 不再发送: %v", m.ID, m.Attempts, err)
+		}
+		updates["status"] = status
+		updates["attempts"] = m.Attempts
+		updates["next_at"] = now.Add(outboxBackoff(m.Attempts))
+	}
+	return o.db.WithContext(ctx).Model(m).Updates(updates).Error
+}
+
+// ReplayDead 将超过重试次数的消息重新置为待发送并清零重试次数, 不指定 id 时处理全部, 返回处理的条数
+func (o *Outbox) ReplayDead(ctx context.Context, ids ...int64) (int64, error) {
+	tx := o.db.WithContext(ctx).Model(&OutboxMessage{}).Where("status = ?", outboxDead)
+	if len(ids) > 0 {
+		tx = tx.Where("id IN ?", ids)
+	}
+	res := tx.Updates(map[string]interface{}{"status": outboxPending, "attempts": 0, "next_at": time.Now()})
+	return res.RowsAffected, res.Error
+}
+
+// cleanup 删除超过保留时间的已发送消息
+func (o *Outbox) cleanup(ctx context.Context) {
+	before := time.Now().Add(-time.Duration(o.conf.KeepSent) * time.Hour)
+	for {
+		res := o.db.WithContext(ctx).Exec("DELETE FROM `_outbox` WHERE status = ? AND sent_at < ? LIMIT 1000", outboxSent, before)
+		if res.Error != nil {
+			ErrorF("[Outbox] 清理已发送消息失败: %v", res.Error)
+			return
+		}
+		if res.RowsAffected < 1000 {
+			return
+		}
+	}
+}
+
+// outboxBackoff 第n次失败后的重试间隔, 指数增长, 最长10分钟
+func outboxBackoff(n int) time.Duration {
+	if n > 10 {
+		return 10 * time.Minute
+	}
+	d := time.Second << n
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+	return d
+}
@@ -0,0 +1,367 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const partitionMonthLayout = "200601"
+
+var Partitions map[string]*PartitionManager
+
+func initPartitions() {
+	Partitions = make(map[string]*PartitionManager, len(Conf.PartitionConf))
+	for _, v := range Conf.PartitionConf {
+		p, err := newPartitionManager(v)
+		if err != nil {
+			panic(err)
+		}
+		Partitions[v.Table] = p
+
+		// 启动时先执行一次, 保证当前月的分区存在
+		if err = p.Maintain(context.Background()); err != nil {
+			ErrorF("[Partition] %s 维护失败: %v", v.Table, err)
+		}
+		go p.run()
+	}
+}
+
+// GetPartition 获取按月分区表的管理器, 通过基础表名获取
+func GetPartition(table string) *PartitionManager {
+	p, ok := Partitions[table]
+	if !ok {
+		panic("[Partition] 未init")
+	}
+	return p
+}
+
+// PartitionTable 时间 t 所在月份写入的表名, 用于 gorm 的 Table(), 见 PartitionManager.Table
+func PartitionTable(table string, t time.Time) string {
+	return GetPartition(table).Table(t)
+}
+
+// PartitionRange 查询 [from, to] 之间各月份的表, 用于 gorm 的 Table(), 见 PartitionManager.Range
+func PartitionRange(table string, from, to time.Time) string {
+	return GetPartition(table).Range(from, to)
+}
+
+// PartitionManager 按月分区表管理, 预创建未来的分区, 清理(或归档后清理)超过保留期的分区
+// clone 模式按基础表结构创建 {table}_YYYYMM, 基础表只作为模板;
+// native 模式使用数据库原生分区, 基础表需预先以 PARTITION BY RANGE 创建(mysql 使用 RANGE COLUMNS), 分区名 pgsql 为 {table}_YYYYMM, mysql 为 pYYYYMM
+type PartitionManager struct {
+	conf    *PartitionConf
+	db      *sql.DB
+	dialect sqlDialect
+	mux     sync.RWMutex
+	months  map[string]bool // 已存在分区的月份 YYYYMM
+	locker  Locker          // 多个实例同时运行时只有一个执行维护
+}
+
+func newPartitionManager(conf *PartitionConf) (*PartitionManager, error) {
+	if conf.Table == "" {
+		return nil, fmt.Errorf("[Partition] 未配置表名")
+	}
+	if conf.Mode == "" {
+		conf.Mode = "clone"
+	}
+	if conf.Mode != "clone" && conf.Mode != "native" {
+		return nil, fmt.Errorf("[Partition] %s 不支持的模式 %s", conf.Table, conf.Mode)
+	}
+	if conf.Precreate < 1 {
+		conf.Precreate = 3
+	}
+	if conf.Interval < 1 {
+		conf.Interval = 3600
+	}
+
+	db, dialect, err := getSqlDB(conf.Tag)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ArchiveTag != "" && conf.Mode == "native" && dialect == dialectMysql {
+		return nil, fmt.Errorf("[Partition] %s mysql 原生分区不支持归档", conf.Table)
+	}
+	return &PartitionManager{
+		conf:    conf,
+		db:      db,
+		dialect: dialect,
+		months:  make(map[string]bool),
+		locker:  &sqlLocker{db: db, dialect: dialect, held: make(map[string]*heldLock)},
+	}, nil
+}
+
+func (p *PartitionManager) run() {
+	ticker := time.NewTicker(time.Duration(p.conf.Interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.Maintain(context.Background()); err != nil {
+			ErrorF("[Partition] %s 维护失败: %v", p.conf.Table, err)
+		}
+	}
+}
+
+// Table 时间 t 所在月份写入的表名, native 模式为基础表(由数据库路由到分区)
+// clone 模式下该月的表不存在时会先创建; 已超过保留期的月份不会创建, 写入时报表不存在, 避免数据写入后被清理
+func (p *PartitionManager) Table(t time.Time) string {
+	if p.conf.Mode == "native" {
+		return p.conf.Table
+	}
+	month := t.In(time.Local).Format(partitionMonthLayout)
+	p.mux.RLock()
+	ok := p.months[month]
+	p.mux.RUnlock()
+	switch {
+	case ok:
+	case p.expired(month):
+		ErrorF("[Partition] %s 已超过保留期 %d 个月, 不再创建", p.partitionName(month), p.conf.Retention)
+	default:
+		if err := p.create(context.Background(), month); err != nil {
+			ErrorF("[Partition] 创建 %s 失败: %v", p.partitionName(month), err)
+		}
+	}
+	return p.partitionName(month)
+}
+
+// expired 月份是否早于保留期, 未配置 retention 时不过期
+func (p *PartitionManager) expired(month string) bool {
+	if p.conf.Retention < 1 {
+		return false
+	}
+	return month < monthStart(time.Now()).AddDate(0, -p.conf.Retention, 0).Format(partitionMonthLayout)
+}
+
+// Range 查询 [from, to] 之间各月份的表, native 模式为基础表, 需自行添加时间条件以裁剪分区
+// clone 模式为已存在月表的 UNION ALL 子查询, 以基础表名(不含schema)作为别名, 没有月表时为基础表
+func (p *PartitionManager) Range(from, to time.Time) string {
+	if p.conf.Mode == "native" {
+		return p.conf.Table
+	}
+	start := monthStart(from)
+	end := monthStart(to)
+
+	p.mux.RLock()
+	var tables []string
+	for m := start; !m.After(end); m = m.AddDate(0, 1, 0) {
+		if month := m.Format(partitionMonthLayout); p.months[month] {
+			tables = append(tables, p.partitionName(month))
+		}
+	}
+	p.mux.RUnlock()
+
+	if len(tables) == 0 {
+		return p.conf.Table
+	}
+	selects := make([]string, len(tables))
+	for i, t := range tables {
+		selects[i] = "SELECT * FROM " + p.dialect.quote(t)
+	}
+	alias := p.conf.Table[strings.LastIndex(p.conf.Table, ".")+1:]
+	return "(" + strings.Join(selects, " UNION ALL ") + ") AS " + alias
+}
+
+// Maintain 执行一次维护: 预创建当前月及未来 precreate 个月的分区, 清理超过保留期的分区
+// 通过数据库锁保证同一时间只有一个实例执行, 未获得锁时只刷新已存在的分区;
+// 某个分区创建或清理失败时继续处理其余分区, 返回全部错误
+func (p *PartitionManager) Maintain(ctx context.Context) error {
+	locked, err := p.locker.TryLock(ctx, "dbHelper:partition:"+p.conf.Table, 0)
+	if err != nil {
+		return err
+	}
+	if locked {
+		defer func() {
+			if err := p.locker.Unlock(context.Background(), "dbHelper:partition:"+p.conf.Table); err != nil {
+				ErrorF("[Partition] %s 释放维护锁失败: %v", p.conf.Table, err)
+			}
+		}()
+	}
+
+	existing, err := p.list(ctx)
+	if err != nil {
+		return err
+	}
+	p.mux.Lock()
+	p.months = make(map[string]bool, len(existing))
+	for _, m := range existing {
+		p.months[m] = true
+	}
+	p.mux.Unlock()
+	if !locked {
+		InfoF("[Partition] %s 其他实例正在维护, 跳过", p.conf.Table)
+		return nil
+	}
+
+	var errs []error
+	current := monthStart(time.Now())
+	for i := 0; i <= p.conf.Precreate; i++ {
+		month := current.AddDate(0, i, 0).Format(partitionMonthLayout)
+		if p.has(month) {
+			continue
+		}
+		// mysql 原生分区只能在最大分区之后追加
+		if p.conf.Mode == "native" && p.dialect == dialectMysql && len(existing) > 0 && month < existing[len(existing)-1] {
+			continue
+		}
+		if err = p.create(ctx, month); err != nil {
+			errs = append(errs, fmt.Errorf("创建 %s 失败: %w", p.partitionName(month), err))
+			continue
+		}
+		InfoF("[Partition] 已创建 %s", p.partitionName(month))
+	}
+
+	for _, month := range existing {
+		if !p.expired(month) {
+			break
+		}
+		if err = p.drop(ctx, month); err != nil {
+			ErrorF("[Partition] 清理 %s 失败, 下次维护时重试: %v", p.partitionName(month), err)
+			errs = append(errs, fmt.Errorf("清理 %s 失败: %w", p.partitionName(month), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *PartitionManager) has(month string) bool {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	return p.months[month]
+}
+
+// partitionName 月份对应的分区表名或分区名
+func (p *PartitionManager) partitionName(month string) string {
+	if p.conf.Mode == "native" && p.dialect == dialectMysql {
+		return "p" + month
+	}
+	return p.conf.Table + "_" + month
+}
+
+// list 已存在分区的月份, 升序
+func (p *PartitionManager) list(ctx context.Context) ([]string, error) {
+	var (
+		query string
+		arg   string
+	)
+	schema, table := "", p.conf.Table
+	if i := strings.LastIndex(table, "."); i > 0 {
+		schema, table = table[:i], table[i+1:]
+	}
+	switch {
+	case p.conf.Mode == "native" && p.dialect == dialectPostgres:
+		query, arg = "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass", p.conf.Table
+	case p.conf.Mode == "native":
+		query, arg = "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL", table
+	case p.dialect == dialectPostgres:
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_name LIKE $1"
+		if schema != "" {
+			query = "SELECT table_name FROM information_schema.tables WHERE table_schema = '" + strings.ReplaceAll(schema, "'", "''") + "' AND table_name LIKE $1"
+		}
+		arg = strings.ReplaceAll(table, "_", `\_`) + `\_%`
+	default:
+		query, arg = "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name LIKE ?", strings.ReplaceAll(table, "_", `\_`)+`\_%`
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	prefix := table + "_"
+	if p.conf.Mode == "native" && p.dialect == dialectMysql {
+		prefix = "p"
+	}
+	months := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		month := strings.TrimPrefix(name, prefix)
+		if len(month) != len(partitionMonthLayout) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(partitionMonthLayout, month); err != nil {
+			continue
+		}
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	return months, rows.Err()
+}
+
+// create 创建月份的分区, 已存在时忽略
+func (p *PartitionManager) create(ctx context.Context, month string) error {
+	start, err := time.ParseInLocation(partitionMonthLayout, month, time.Local)
+	if err != nil {
+		return err
+	}
+	from := start.Format("2006-01-02")
+	to := start.AddDate(0, 1, 0).Format("2006-01-02")
+	table := p.dialect.quote(p.conf.Table)
+	name := p.partitionName(month)
+
+	var query string
+	switch {
+	case p.conf.Mode == "native" && p.dialect == dialectPostgres:
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')", p.dialect.quote(name), table, from, to)
+	case p.conf.Mode == "native":
+		query = fmt.Sprintf("ALTER TABLE %s ADD PARTITION (PARTITION %s VALUES LESS THAN ('%s'))", table, p.dialect.quote(name), to)
+	case p.dialect == dialectPostgres:
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s INCLUDING ALL)", p.dialect.quote(name), table)
+	default:
+		query = fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s LIKE %s", p.dialect.quote(name), table)
+	}
+	if _, err = p.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	p.months[month] = true
+	p.mux.Unlock()
+	return nil
+}
+
+// drop 删除月份的分区, 配置了归档时先复制到归档标记
+// 归档按主键覆盖写入, 复制或删除中途失败后重新执行不会产生重复数据
+func (p *PartitionManager) drop(ctx context.Context, month string) error {
+	name := p.partitionName(month)
+	if p.conf.ArchiveTag != "" {
+		n, err := CopyTable(ctx, p.conf.Tag, p.conf.ArchiveTag, &CopyTableSpec{
+			SrcTable:   name,
+			DstTable:   p.conf.ArchiveTable,
+			PrimaryKey: p.conf.PrimaryKey,
+			Upsert:     true,
+		})
+		if err != nil {
+			return fmt.Errorf("归档失败: %w", err)
+		}
+		InfoF("[Partition] %s 已归档 %d 行到 %s", name, n, p.conf.ArchiveTag)
+	}
+
+	query := "DROP TABLE IF EXISTS " + p.dialect.quote(name)
+	if p.conf.Mode == "native" && p.dialect == dialectMysql {
+		query = fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s", p.dialect.quote(p.conf.Table), p.dialect.quote(name))
+	}
+	if _, err := p.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	delete(p.months, month)
+	p.mux.Unlock()
+	InfoF("[Partition] 已清理 %s", name)
+	return nil
+}
+
+// monthStart t 所在月份的第一天
+func monthStart(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+}
@@ -0,0 +1,200 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"strings"
+)
+
+// PgRowSource COPY 的数据来源, Next 返回 io.EOF 表示数据结束
+type PgRowSource interface {
+	Next() ([]interface{}, error)
+}
+
+// PgRowFunc 以函数作为数据来源
+type PgRowFunc func() ([]interface{}, error)
+
+func (f PgRowFunc) Next() ([]interface{}, error) {
+	return f()
+}
+
+// PgRowsFromSlice 以切片作为数据来源
+func PgRowsFromSlice(rows [][]interface{}) PgRowSource {
+	i := 0
+	return PgRowFunc(func() ([]interface{}, error) {
+		if i >= len(rows) {
+			return nil, io.EOF
+		}
+		i++
+		return rows[i-1], nil
+	})
+}
+
+// PgRowsFromChan 以通道作为数据来源, 通道关闭表示数据结束
+func PgRowsFromChan(ch <-chan []interface{}) PgRowSource {
+	return PgRowFunc(func() ([]interface{}, error) {
+		row, ok := <-ch
+		if !ok {
+			return nil, io.EOF
+		}
+		return row, nil
+	})
+}
+
+// PgRowsFromCSV 以csv作为数据来源, skipHeader 为 true 时跳过首行
+func PgRowsFromCSV(r *csv.Reader, skipHeader bool) PgRowSource {
+	return PgRowFunc(func() ([]interface{}, error) {
+		if skipHeader {
+			skipHeader = false
+			if _, err := r.Read(); err != nil {
+				return nil, err
+			}
+		}
+		record, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(record))
+		for i, v := range record {
+			row[i] = v
+		}
+		return row, nil
+	})
+}
+
+// PgCopyOptions COPY 参数
+type PgCopyOptions struct {
+	ProgressEvery   int64            // 每复制多少行回调一次进度 默认10000
+	OnProgress      func(rows int64) // 进度回调, 参数为已复制行数
+	ConflictColumns []string         // 非空时先 COPY 到临时表, 再 INSERT ... ON CONFLICT 合并到目标表
+	UpdateColumns   []string         // 冲突时更新的列, 默认为 columns 中除冲突列以外的列, 没有需要更新的列时 DO NOTHING
+}
+
+// PgCopyFrom 使用 COPY 协议将数据批量导入 pgsql 标记的表, 在一个事务中完成, 返回导入行数
+func PgCopyFrom(ctx context.Context, tag, table string, columns []string, src PgRowSource, opt *PgCopyOptions) (int64, error) {
+	if opt == nil {
+		opt = &PgCopyOptions{}
+	}
+	if opt.ProgressEvery < 1 {
+		opt.ProgressEvery = 10000
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("[PgCopyFrom] 未指定列")
+	}
+
+	tx, err := GetPgsqlConn(tag).BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	target := table
+	if len(opt.ConflictColumns) > 0 {
+		target = "dbhelper_copy_" + strings.ReplaceAll(table, ".", "_")
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+			dialectPostgres.quote(target), dialectPostgres.quote(table)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var copySql string
+	if i := strings.Index(target, "."); i > 0 {
+		copySql = pq.CopyInSchema(target[:i], target[i+1:], columns...)
+	} else {
+		copySql = pq.CopyIn(target, columns...)
+	}
+	stmt, err := tx.PrepareContext(ctx, copySql)
+	if err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	for {
+		row, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = stmt.Close()
+			return rows, err
+		}
+		if len(row) != len(columns) {
+			_ = stmt.Close()
+			return rows, fmt.Errorf("[PgCopyFrom] 第 %d 行有 %d 个值, 需要 %d 个", rows+1, len(row), len(columns))
+		}
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			_ = stmt.Close()
+			return rows, err
+		}
+		rows++
+		if opt.OnProgress != nil && rows%opt.ProgressEvery == 0 {
+			opt.OnProgress(rows)
+		}
+	}
+
+	// 无参数的 Exec 将缓冲区的数据发送给服务端
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		return rows, err
+	}
+	if err = stmt.Close(); err != nil {
+		return rows, err
+	}
+
+	if len(opt.ConflictColumns) > 0 {
+		if err = pgCopyMerge(ctx, tx, table, target, columns, opt); err != nil {
+			return rows, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return rows, err
+	}
+	if opt.OnProgress != nil && rows%opt.ProgressEvery != 0 {
+		opt.OnProgress(rows)
+	}
+	InfoF("[PgCopyFrom] %s 导入 %d 行", table, rows)
+	return rows, nil
+}
+
+// pgCopyMerge 将临时表的数据合并到目标表
+func pgCopyMerge(ctx context.Context, tx *sql.Tx, table, tmp string, columns []string, opt *PgCopyOptions) error {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = dialectPostgres.quote(c)
+	}
+	conflict := make([]string, len(opt.ConflictColumns))
+	for i, c := range opt.ConflictColumns {
+		conflict[i] = dialectPostgres.quote(c)
+	}
+
+	update := opt.UpdateColumns
+	if len(update) == 0 {
+		for _, c := range columns {
+			if !SliceContains(opt.ConflictColumns, c) {
+				update = append(update, c)
+			}
+		}
+	}
+	action := "DO NOTHING"
+	if len(update) > 0 {
+		sets := make([]string, len(update))
+		for i, c := range update {
+			sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", dialectPostgres.quote(c), dialectPostgres.quote(c))
+		}
+		action = "DO UPDATE SET " + strings.Join(sets, ", ")
+	}
+
+	cols := strings.Join(quoted, ", ")
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) %s",
+		dialectPostgres.quote(table), cols, cols, dialectPostgres.quote(tmp), strings.Join(conflict, ", "), action))
+	return err
+}
@@ -0,0 +1,95 @@
+package dbHelper
+
+import (
+	"context"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+// PgNotification LISTEN 收到的通知
+// Reconnected 为 true 表示连接断开后已重新连接并重新 LISTEN, 断开期间的通知可能丢失, 消费者应重新同步数据
+type PgNotification struct {
+	Channel     string
+	Payload     string
+	BePid       int // 发出通知的后端进程id
+	Reconnected bool
+}
+
+// PgListen 在专用连接上 LISTEN 指定频道, 连接断开后自动重连并重新 LISTEN
+// 开启ssh时通过已建立的ssh隧道连接; ctx 结束时关闭连接并关闭返回的通道
+func PgListen(ctx context.Context, tag string, channels ...string) (<-chan *PgNotification, error) {
+	dsn, ok := pgsqlDSNs[tag]
+	if !ok {
+		return nil, fmt.Errorf("[PgListen] PostgreSQL标记 %s 未init", tag)
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("[PgListen] 未指定频道")
+	}
+
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected:
+			InfoF("[PgListen] %s 已连接 %v", tag, channels)
+		case pq.ListenerEventDisconnected:
+			ErrorF("[PgListen] %s 连接断开: %v", tag, err)
+		case pq.ListenerEventReconnected:
+			InfoF("[PgListen] %s 已重新连接 %v", tag, channels)
+		case pq.ListenerEventConnectionAttemptFailed:
+			ErrorF("[PgListen] %s 重新连接失败: %v", tag, err)
+		}
+	})
+
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
+	out := make(chan *PgNotification, 64)
+	go func() {
+		defer close(out)
+		defer func() {
+			_ = listener.Close()
+		}()
+
+		// 定期 ping, 尽早发现静默断开的连接
+		ticker := time.NewTicker(90 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			var msg *PgNotification
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				go func() {
+					_ = listener.Ping()
+				}()
+				continue
+			case n := <-listener.Notify:
+				// lib/pq 在重新连接后发送 nil
+				if n == nil {
+					msg = &PgNotification{Reconnected: true}
+				} else {
+					msg = &PgNotification{Channel: n.Channel, Payload: n.Extra, BePid: n.BePid}
+				}
+			}
+
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// PgNotify 通过连接池发送通知
+func PgNotify(ctx context.Context, tag, channel, payload string) error {
+	_, err := GetPgsqlConn(tag).ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
@@ -0,0 +1,397 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgsql 语句日志级别
+const (
+	pgLogSilent = iota
+	pgLogError
+	pgLogWarn
+	pgLogInfo
+)
+
+// pgLogConnector 包装 lib/pq 的 Connector, 连接执行的 Query/Exec 输出耗时、行数、错误与调用位置
+type pgLogConnector struct {
+	driver.Connector
+	level         int
+	slowThreshold time.Duration
+	logArgs       bool
+}
+
+func newPgLogConnector(connector driver.Connector, conf *PgsqlConf) *pgLogConnector {
+	if conf.SlowThreshold == 0 {
+		conf.SlowThreshold = 200
+	}
+	c := &pgLogConnector{
+		Connector:     connector,
+		level:         pgLogInfo,
+		slowThreshold: time.Duration(conf.SlowThreshold) * time.Millisecond,
+		logArgs:       conf.LogArgs,
+	}
+	switch strings.ToLower(conf.LogLevel) {
+	case "silent":
+		c.level = pgLogSilent
+	case "error":
+		c.level = pgLogError
+	case "warn":
+		c.level = pgLogWarn
+	}
+	return c
+}
+
+func (c *pgLogConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.level == pgLogSilent {
+		return conn, nil
+	}
+	return &pgLogConn{Conn: conn, c: c}, nil
+}
+
+// log 出错输出 error, 超过慢查询阈值输出 warn 后与其余语句一样输出 info
+// 参数值可能包含敏感数据, 只有开启 logArgs 时输出, 否则只输出参数个数
+func (c *pgLogConnector) log(caller string, begin time.Time, query string, args []driver.NamedValue, rows int64, err error) {
+	elapsed := time.Since(begin)
+	if len(args) > 0 && c.logArgs {
+		values := make([]interface{}, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		query = fmt.Sprintf("%s \t| args= %v", query, values)
+	} else if len(args) > 0 {
+		query = fmt.Sprintf("%s \t| args= %d个", query, len(args))
+	}
+	if err != nil {
+		if c.level >= pgLogError {
+			ErrorFTimes(-1, "%s \t| [PgSQL-Error]\t| err = %v \t| rows= %v \t| %v \t| %v", caller, err, rows, elapsed, query)
+		}
+		return
+	}
+	if c.slowThreshold > 0 && elapsed > c.slowThreshold && c.level >= pgLogWarn {
+		WarnFTimes(-1, "%s \t| [PgSQL-SlowLog]\t| rows= %v \t| %v \t| %v", caller, rows, elapsed, query)
+	}
+	if c.level >= pgLogInfo {
+		InfoFTimes(-1, "%s \t| [PgSQL]\t| rows= %v \t| %v \t| %v", caller, rows, elapsed, query)
+	}
+}
+
+type pgLogSkipKey struct{}
+
+// pgLogSkipGorm 标记经过 gorm 执行的语句, 这些语句已由 GormLogger 输出, 驱动层不再重复输出
+func pgLogSkipGorm(orm *gorm.DB) error {
+	mark := func(db *gorm.DB) {
+		if pgLogSkip(db.Statement.Context) {
+			return
+		}
+		db.Statement.Context = context.WithValue(db.Statement.Context, pgLogSkipKey{}, true)
+	}
+	cb := orm.Callback()
+	if err := cb.Create().Before("*").Register("dbHelper:pg_log_skip", mark); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("*").Register("dbHelper:pg_log_skip", mark); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("*").Register("dbHelper:pg_log_skip", mark); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("*").Register("dbHelper:pg_log_skip", mark); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("*").Register("dbHelper:pg_log_skip", mark); err != nil {
+		return err
+	}
+	return cb.Raw().Before("*").Register("dbHelper:pg_log_skip", mark)
+}
+
+// pgLogSkip 语句是否已在 gorm 中输出日志
+func pgLogSkip(ctx context.Context) bool {
+	return ctx.Value(pgLogSkipKey{}) != nil
+}
+
+type pgLogConn struct {
+	driver.Conn
+	c *pgLogConnector
+}
+
+var (
+	_ driver.ConnBeginTx        = (*pgLogConn)(nil)
+	_ driver.ConnPrepareContext = (*pgLogConn)(nil)
+	_ driver.QueryerContext     = (*pgLogConn)(nil)
+	_ driver.ExecerContext      = (*pgLogConn)(nil)
+	_ driver.Pinger             = (*pgLogConn)(nil)
+	_ driver.SessionResetter    = (*pgLogConn)(nil)
+	_ driver.Validator          = (*pgLogConn)(nil)
+)
+
+func (cn *pgLogConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return cn.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// PrepareContext 返回包装后的 Stmt, 每次执行输出日志; COPY 语句只在最后一次不带参数的 Exec(提交数据)时输出, 耗时从预处理开始计算
+func (cn *pgLogConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := cn.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		if !pgLogSkip(ctx) {
+			cn.c.log(sqlCaller(), time.Now(), query, nil, 0, err)
+		}
+		return nil, err
+	}
+	s := &pgLogStmt{Stmt: stmt, c: cn.c, query: query}
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "COPY ") {
+		s.copy, s.begin = true, time.Now()
+	}
+	return s, nil
+}
+
+func (cn *pgLogConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if pgLogSkip(ctx) {
+		return cn.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	}
+	caller := sqlCaller()
+	begin := time.Now()
+	rows, err := cn.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		if !errors.Is(err, driver.ErrSkip) {
+			cn.c.log(caller, begin, query, args, 0, err)
+		}
+		return rows, err
+	}
+	return &pgLogRows{Rows: rows, c: cn.c, caller: caller, begin: begin, query: query, args: args}, nil
+}
+
+func (cn *pgLogConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if pgLogSkip(ctx) {
+		return cn.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	}
+	caller := sqlCaller()
+	begin := time.Now()
+	res, err := cn.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if errors.Is(err, driver.ErrSkip) {
+		return res, err
+	}
+	var rows int64
+	if err == nil {
+		rows, _ = res.RowsAffected()
+	}
+	cn.c.log(caller, begin, query, args, rows, err)
+	return res, err
+}
+
+func (cn *pgLogConn) Ping(ctx context.Context) error {
+	return cn.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (cn *pgLogConn) ResetSession(ctx context.Context) error {
+	return cn.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (cn *pgLogConn) IsValid() bool {
+	return cn.Conn.(driver.Validator).IsValid()
+}
+
+// pgLogStmt 预处理语句, 与 pgLogConn 一样输出日志, gorm 执行的语句不输出
+type pgLogStmt struct {
+	driver.Stmt
+	c     *pgLogConnector
+	query string
+	copy  bool
+	begin time.Time
+}
+
+var (
+	_ driver.StmtQueryContext = (*pgLogStmt)(nil)
+	_ driver.StmtExecContext  = (*pgLogStmt)(nil)
+)
+
+func (s *pgLogStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if pgLogSkip(ctx) || s.copy {
+		return s.rawQuery(ctx, args)
+	}
+	caller := sqlCaller()
+	begin := time.Now()
+	rows, err := s.rawQuery(ctx, args)
+	if err != nil {
+		s.c.log(caller, begin, s.query, args, 0, err)
+		return rows, err
+	}
+	return &pgLogRows{Rows: rows, c: s.c, caller: caller, begin: begin, query: s.query, args: args}, nil
+}
+
+func (s *pgLogStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if pgLogSkip(ctx) || (s.copy && len(args) > 0) {
+		return s.rawExec(ctx, args)
+	}
+	caller := sqlCaller()
+	begin := time.Now()
+	if s.copy {
+		begin = s.begin
+	}
+	res, err := s.rawExec(ctx, args)
+	var rows int64
+	if err == nil {
+		rows, _ = res.RowsAffected()
+	}
+	s.c.log(caller, begin, s.query, args, rows, err)
+	return res, err
+}
+
+// rawQuery 驱动的 COPY 语句只实现了不带 context 的 Query/Exec, 此时转换为 driver.Value 调用
+func (s *pgLogStmt) rawQuery(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if qs, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return qs.QueryContext(ctx, args)
+	}
+	values, err := pgLogValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(values)
+}
+
+func (s *pgLogStmt) rawExec(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if es, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return es.ExecContext(ctx, args)
+	}
+	values, err := pgLogValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func pgLogValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		if a.Name != "" {
+			return nil, fmt.Errorf("[PgSQL] 不支持命名参数 %s", a.Name)
+		}
+		values[i] = a.Value
+	}
+	return values, nil
+}
+
+// pgLogRows 统计读取的行数, 关闭时输出日志
+type pgLogRows struct {
+	driver.Rows
+	c      *pgLogConnector
+	caller string
+	begin  time.Time
+	query  string
+	args   []driver.NamedValue
+	rows   int64
+	err    error
+}
+
+func (r *pgLogRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.rows++
+	} else if !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+	return err
+}
+
+func (r *pgLogRows) Close() error {
+	err := r.Rows.Close()
+	logErr := r.err
+	if logErr == nil {
+		logErr = err
+	}
+	r.c.log(r.caller, r.begin, r.query, r.args, r.rows, logErr)
+	return err
+}
+
+// 以下转发驱动 Rows 的可选接口, scanMaps 等依赖列类型信息
+
+func (r *pgLogRows) ColumnTypeDatabaseTypeName(index int) string {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return rs.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *pgLogRows) ColumnTypeScanType(index int) reflect.Type {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return rs.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *pgLogRows) ColumnTypeLength(index int) (int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return rs.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *pgLogRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return rs.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func (r *pgLogRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *pgLogRows) NextResultSet() error {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+	return io.EOF
+}
+
+var dbHelperPkg = reflect.TypeOf(pgLogConn{}).PkgPath() + "."
+
+// sqlCaller 跳过 database/sql、gorm 与 dbHelper 内部的调用, 返回业务代码的调用位置
+func sqlCaller() string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	fallback := ""
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "database/sql.") || strings.HasPrefix(frame.Function, "runtime.")
+		if !internal {
+			location := shortFile(frame.File) + ":" + strconv.Itoa(frame.Line)
+			if !strings.HasPrefix(frame.Function, dbHelperPkg) && !strings.HasPrefix(frame.Function, "gorm.io/") {
+				return location
+			}
+			if fallback == "" {
+				fallback = location
+			}
+		}
+		if !more {
+			return fallback
+		}
+	}
+}
+
+// shortFile 与日志一致, 最多显示两级路径
+func shortFile(file string) string {
+	fileList := strings.Split(file, "/")
+	if len(fileList) > 3 {
+		fileList = fileList[len(fileList)-3:]
+	}
+	return strings.Join(fileList, "/")
+}
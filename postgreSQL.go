@@ -3,12 +3,21 @@ package dbHelper
 import (
 	"database/sql"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var PgsqlConn map[string]*sql.DB
 
+var PgsqlGorm map[string]*gorm.DB
+
+// pgsqlDSNs 各标记的连接字符串, 用于建立连接池之外的专用连接
+var pgsqlDSNs map[string]string
+
 func GetPgsqlConn(tag string) *sql.DB {
 	m, ok := PgsqlConn[tag]
 	if !ok {
@@ -17,14 +26,35 @@ func GetPgsqlConn(tag string) *sql.DB {
 	return m
 }
 
+// GetPgsqlGorm 获取 gorm 连接, 与 GetPgsqlConn 共用同一个连接池
+func GetPgsqlGorm(tag string) *gorm.DB {
+	m, ok := PgsqlGorm[tag]
+	if !ok {
+		panic("[PostgreSQL] 未init")
+	}
+	return m
+}
+
 func initPgsqlConn() {
 	PgsqlConn = make(map[string]*sql.DB, len(Conf.PgsqlConf))
+	PgsqlGorm = make(map[string]*gorm.DB, len(Conf.PgsqlConf))
+	pgsqlDSNs = make(map[string]string, len(Conf.PgsqlConf))
 	for _, v := range Conf.PgsqlConf {
 		m, err := pgsqlConn(v)
 		if err != nil {
 			panic(err)
 		}
 		PgsqlConn[v.Tag] = m
+
+		// gorm 的语句由 GormLogger 输出, 驱动层只输出直接使用 *sql.DB 执行的语句
+		orm, err := gorm.Open(postgres.New(postgres.Config{Conn: m}), newGormConfig())
+		if err != nil {
+			panic(err)
+		}
+		if err = pgLogSkipGorm(orm); err != nil {
+			panic(err)
+		}
+		PgsqlGorm[v.Tag] = orm
 	}
 }
 
@@ -42,6 +72,7 @@ func pgsqlConn(conf *PgsqlConf) (*sql.DB, error) {
 			User:       conf.SSHUsername,
 			Password:   conf.SSHPassword,
 			PrivateKey: conf.SSHPrivateKey,
+			Passphrase: conf.SSHPassphrase,
 			RemoteHost: conf.SSHRemoteHost,
 			RemotePort: conf.SSHRemotePort,
 			TargetHost: conf.Host,
@@ -72,23 +103,20 @@ func pgsqlConn(conf *PgsqlConf) (*sql.DB, error) {
 		panic("数据库配置信息获取失败")
 	}
 
-	// 构建连接字符串
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, conf.User, conf.Password, conf.Database)
-
 	// 打开数据库连接
-	db, err = sql.Open("postgres", psqlInfo)
+	dsn := pgsqlDSN(conf, host, port)
+	connector, err := pq.NewConnector(dsn)
 	if err != nil {
 		Error(err)
+		return nil, err
 	}
-	defer func() {
-		_ = db.Close()
-	}()
+	db = sql.OpenDB(newPgLogConnector(connector, conf))
 
 	// 测试连接
 	err = db.Ping()
 	if err != nil {
 		Error(err)
+		_ = db.Close()
 		return nil, err
 	}
 
@@ -102,9 +130,52 @@ func pgsqlConn(conf *PgsqlConf) (*sql.DB, error) {
 	if conf.MaxLifeTime == 0 {
 		conf.MaxLifeTime = 60 * 1000 //60s
 	}
+	if conf.MaxIdleTime == 0 {
+		conf.MaxIdleTime = 60 * 1000 //60s
+	}
 	db.SetMaxOpenConns(int(conf.MaxOpen))
 	db.SetMaxIdleConns(int(conf.MaxIdle))
 	db.SetConnMaxLifetime(time.Duration(conf.MaxLifeTime) * time.Millisecond)
+	db.SetConnMaxIdleTime(time.Duration(conf.MaxIdleTime) * time.Millisecond)
 
+	pgsqlDSNs[conf.Tag] = dsn
 	return db, nil
 }
+
+// pgsqlDSN 构建 lib/pq 连接字符串, search_path 与 statement_timeout 作为运行时参数在建立连接时设置
+func pgsqlDSN(conf *PgsqlConf, host string, port int64) string {
+	if conf.SSLMode == "" {
+		conf.SSLMode = "disable"
+	}
+
+	params := [][2]string{
+		{"host", host},
+		{"port", strconv.FormatInt(port, 10)},
+		{"user", conf.User},
+		{"password", conf.Password},
+		{"dbname", conf.Database},
+		{"sslmode", conf.SSLMode},
+		{"sslrootcert", conf.SSLRootCert},
+		{"sslcert", conf.SSLCert},
+		{"sslkey", conf.SSLKey},
+		{"search_path", conf.SearchPath},
+		{"application_name", conf.ApplicationName},
+	}
+	if conf.ConnectTimeout > 0 {
+		params = append(params, [2]string{"connect_timeout", strconv.FormatInt(conf.ConnectTimeout, 10)})
+	}
+	if conf.StatementTimeout > 0 {
+		params = append(params, [2]string{"statement_timeout", strconv.FormatInt(conf.StatementTimeout, 10)})
+	}
+
+	list := make([]string, 0, len(params))
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		v := strings.ReplaceAll(p[1], `\`, `\\`)
+		v = strings.ReplaceAll(v, `'`, `\'`)
+		list = append(list, fmt.Sprintf("%s='%s'", p[0], v))
+	}
+	return strings.Join(list, " ")
+}
@@ -0,0 +1,334 @@
+package dbHelper
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 限流脚本统一使用redis服务端时间, 避免各实例时钟不一致
+// 返回 {是否允许, 剩余额度, 需等待的毫秒数(-1表示n超过上限永远无法满足)}
+
+// GCRA 令牌桶, KEYS[1] 保存理论到达时间(TAT), ARGV: 每个令牌的间隔毫秒, 桶容量, 本次消耗
+var rateLimitGCRAScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + tonumber(t[2]) / 1000
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local tolerance = interval * burst
+
+if n > burst then
+	return {0, 0, -1}
+end
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local newTat = tat + interval * n
+local diff = now - (newTat - tolerance)
+if diff < 0 then
+	return {0, math.floor((now - (tat - tolerance)) / interval), math.ceil(-diff)}
+end
+redis.call('SET', KEYS[1], tostring(newTat), 'PX', math.max(1, math.ceil(newTat - now)))
+return {1, math.floor(diff / interval), 0}
+`)
+
+// 滑动窗口日志, KEYS[1] 为请求时间的有序集合, ARGV: 窗口毫秒, 上限, 本次消耗, 成员唯一前缀
+var rateLimitWindowScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+if n > limit then
+	return {0, 0, -1}
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count + n > limit then
+	-- 等到第 count+n-limit 条记录移出窗口
+	local oldest = redis.call('ZRANGE', KEYS[1], count + n - limit - 1, count + n - limit - 1, 'WITHSCORES')
+	return {0, limit - count, tonumber(oldest[2]) + window - now}
+end
+for i = 1, n do
+	redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, limit - count - n, 0}
+`)
+
+// 并发信号量, KEYS[1] 为租约到期时间的有序集合, KEYS[2] 为租约占用的数量, KEYS[3] 为占用总数, ARGV: 上限, 本次占用, 租约id, 租约毫秒
+// 占用总数随加锁、释放、过期增减, 不需要每次遍历全部租约
+var rateLimitAcquireScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[4])
+
+if n > limit then
+	return {0, 0, -1}
+end
+
+local hasUsed = redis.call('EXISTS', KEYS[3]) == 1
+
+-- 清理持有者崩溃后未释放的租约, 只累加被清理的租约; unpack 的参数个数有上限, 每次最多处理1000个
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now)
+if #expired > 0 then
+	redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+	local freed = 0
+	for i = 1, #expired, 1000 do
+		local j = math.min(i + 999, #expired)
+		for _, v in ipairs(redis.call('HMGET', KEYS[2], unpack(expired, i, j))) do
+			if v then
+				freed = freed + tonumber(v)
+			end
+		end
+		redis.call('HDEL', KEYS[2], unpack(expired, i, j))
+	end
+	if hasUsed and freed > 0 then
+		redis.call('DECRBY', KEYS[3], freed)
+	end
+end
+
+local used = -1
+if hasUsed then
+	used = tonumber(redis.call('GET', KEYS[3]))
+end
+if used < 0 then
+	-- 总数不存在(如之前版本写入的租约)或异常时按租约重新统计一次
+	used = 0
+	for _, v in ipairs(redis.call('HVALS', KEYS[2])) do
+		used = used + tonumber(v)
+	end
+	local pttl = redis.call('PTTL', KEYS[2])
+	if used > 0 and pttl > 0 then
+		redis.call('SET', KEYS[3], used, 'PX', pttl)
+	else
+		redis.call('DEL', KEYS[3])
+	end
+end
+
+if used + n > limit then
+	local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	if #first == 0 then
+		return {0, limit - used, 0}
+	end
+	return {0, limit - used, tonumber(first[2]) - now}
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[3])
+redis.call('HSET', KEYS[2], ARGV[3], n)
+redis.call('INCRBY', KEYS[3], n)
+redis.call('PEXPIRE', KEYS[1], ttl)
+redis.call('PEXPIRE', KEYS[2], ttl)
+redis.call('PEXPIRE', KEYS[3], ttl)
+return {1, limit - used - n, 0}
+`)
+
+// KEYS 同 rateLimitAcquireScript, ARGV: 租约id; 返回0表示租约已过期
+var rateLimitReleaseScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+local n = redis.call('HGET', KEYS[2], ARGV[1])
+if not n then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+-- 总数不存在时不扣减, 下次加锁时重新统计
+if redis.call('EXISTS', KEYS[3]) == 1 and redis.call('DECRBY', KEYS[3], n) < 0 then
+	redis.call('DEL', KEYS[3])
+end
+return 1
+`)
+
+// RateLimitResult 限流结果
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int64         // 剩余额度
+	RetryAfter time.Duration // 未允许时建议的等待时间, -1 表示 n 超过上限永远无法满足
+	Lease      string        // ConcurrencyLimiter 的租约id, 用完后调用 Release
+}
+
+// RateLimiter 基于redis的限流, 多个实例共享同一个key的额度
+type RateLimiter interface {
+	// Allow 尝试消耗 n 个额度
+	Allow(ctx context.Context, key string, n int64) (*RateLimitResult, error)
+}
+
+func runRateLimitScript(ctx context.Context, tag string, script *redis.Script, keys []string, args ...interface{}) (*RateLimitResult, error) {
+	res, err := script.Run(ctx, GetRedisConn(tag), keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 3 {
+		return nil, fmt.Errorf("[RateLimiter] 脚本返回值错误: %v", res)
+	}
+	r := &RateLimitResult{Allowed: res[0] == 1, Remaining: res[1], RetryAfter: time.Duration(res[2]) * time.Millisecond}
+	if res[2] < 0 {
+		r.RetryAfter = -1
+	}
+	return r, nil
+}
+
+// TokenBucketLimiter GCRA 实现的令牌桶, 每 period 补充 rate 个令牌, 最多积攒 burst 个
+// 只保存一个时间戳, 不需要定时补充令牌
+type TokenBucketLimiter struct {
+	tag      string
+	interval float64 // 每个令牌的间隔毫秒
+	burst    int64
+}
+
+// NewTokenBucketLimiter 在redis标记上创建令牌桶限流, burst 小于1时等于 rate
+func NewTokenBucketLimiter(tag string, rate int64, period time.Duration, burst int64) *TokenBucketLimiter {
+	GetRedisConn(tag)
+	if rate < 1 || period <= 0 {
+		panic("[RateLimiter] rate 与 period 必须大于0")
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &TokenBucketLimiter{
+		tag:      tag,
+		interval: float64(period) / float64(time.Millisecond) / float64(rate),
+		burst:    burst,
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(ctx context.Context, key string, n int64) (*RateLimitResult, error) {
+	return runRateLimitScript(ctx, l.tag, rateLimitGCRAScript, []string{"dbHelper:ratelimit:gcra:{" + key + "}"},
+		strconv.FormatFloat(l.interval, 'f', -1, 64), l.burst, n)
+}
+
+// SlidingWindowLimiter 滑动窗口日志, 任意 window 时长内最多 limit 次, 每次请求占用有序集合中的一条记录
+type SlidingWindowLimiter struct {
+	tag    string
+	limit  int64
+	window time.Duration
+}
+
+// NewSlidingWindowLimiter 在redis标记上创建滑动窗口限流, 精确但内存占用与 limit 成正比
+func NewSlidingWindowLimiter(tag string, limit int64, window time.Duration) *SlidingWindowLimiter {
+	GetRedisConn(tag)
+	if limit < 1 || window < time.Millisecond {
+		panic("[RateLimiter] limit 与 window 必须大于0")
+	}
+	return &SlidingWindowLimiter{tag: tag, limit: limit, window: window}
+}
+
+func (l *SlidingWindowLimiter) Allow(ctx context.Context, key string, n int64) (*RateLimitResult, error) {
+	return runRateLimitScript(ctx, l.tag, rateLimitWindowScript, []string{"dbHelper:ratelimit:window:{" + key + "}"},
+		l.window.Milliseconds(), l.limit, n, GetUUID())
+}
+
+// ConcurrencyLimiter 并发信号量, 同一个key同时最多占用 limit 个
+// 成功时返回租约, 用完后调用 Release; 持有者崩溃未释放时租约在 leaseTTL 后自动过期
+type ConcurrencyLimiter struct {
+	tag      string
+	limit    int64
+	leaseTTL time.Duration
+}
+
+// NewConcurrencyLimiter 在redis标记上创建并发限制, leaseTTL 应大于单次处理的最长耗时 默认1分钟
+func NewConcurrencyLimiter(tag string, limit int64, leaseTTL time.Duration) *ConcurrencyLimiter {
+	GetRedisConn(tag)
+	if limit < 1 {
+		panic("[RateLimiter] limit 必须大于0")
+	}
+	if leaseTTL < time.Millisecond {
+		leaseTTL = time.Minute
+	}
+	return &ConcurrencyLimiter{tag: tag, limit: limit, leaseTTL: leaseTTL}
+}
+
+func (l *ConcurrencyLimiter) keys(key string) []string {
+	prefix := "dbHelper:ratelimit:sem:{" + key + "}"
+	return []string{prefix, prefix + ":n", prefix + ":used"}
+}
+
+// Allow 占用 n 个并发额度, 未允许时 RetryAfter 为最早一个租约的到期时间
+func (l *ConcurrencyLimiter) Allow(ctx context.Context, key string, n int64) (*RateLimitResult, error) {
+	lease := GetUUID()
+	res, err := runRateLimitScript(ctx, l.tag, rateLimitAcquireScript, l.keys(key), l.limit, n, lease, l.leaseTTL.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	if res.Allowed {
+		res.Lease = lease
+	}
+	return res, nil
+}
+
+// Release 释放租约, 租约已过期时返回 ErrLockNotHeld
+func (l *ConcurrencyLimiter) Release(ctx context.Context, key, lease string) error {
+	n, err := rateLimitReleaseScript.Run(ctx, GetRedisConn(l.tag), l.keys(key), lease).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// RateLimitByIP 按客户端IP限流的 key
+func RateLimitByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitMiddleware http 限流中间件, 每个请求消耗1个额度, keyFunc 返回空字符串时不限流
+// 超出时返回 429 并设置 Retry-After; redis 出错时放行, 避免限流故障影响业务
+// limiter 为 *ConcurrencyLimiter 时请求处理完成后释放租约
+func RateLimitMiddleware(limiter RateLimiter, keyFunc func(r *http.Request) string) func(http.Handler) http.Handler {
+	if keyFunc == nil {
+		keyFunc = RateLimitByIP
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			res, err := limiter.Allow(r.Context(), key, 1)
+			if err != nil {
+				WarnF("[RateLimiter] 限流检查失败, 放行 key = %s err = %v", key, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+			if !res.Allowed {
+				if res.RetryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+				}
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			if c, ok := limiter.(*ConcurrencyLimiter); ok {
+				defer func() {
+					if err := c.Release(context.WithoutCancel(r.Context()), key, res.Lease); err != nil {
+						WarnF("[RateLimiter] 释放租约失败 key = %s err = %v", key, err)
+					}
+				}()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
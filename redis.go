@@ -2,17 +2,19 @@ package dbHelper
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/redis/go-redis/v9"
-	"golang.org/x/crypto/ssh"
 	"net"
+	"os"
 	"time"
 )
 
-var RedisConn map[string]*redis.Client
+var RedisConn map[string]redis.UniversalClient
 
 func initRedisConn() {
-	RedisConn = make(map[string]*redis.Client, len(Conf.RedisConf))
+	RedisConn = make(map[string]redis.UniversalClient, len(Conf.RedisConf))
 	for _, v := range Conf.RedisConf {
 		m, err := redisConn(v)
 		if err != nil {
@@ -22,7 +24,8 @@ func initRedisConn() {
 	}
 }
 
-func GetRedisConn(tag string) *redis.Client {
+// GetRedisConn 获取redis连接, 单机、哨兵、集群模式都返回 redis.UniversalClient
+func GetRedisConn(tag string) redis.UniversalClient {
 	m, ok := RedisConn[tag]
 	if !ok {
 		panic("[Redis] 未init")
@@ -30,52 +33,115 @@ func GetRedisConn(tag string) *redis.Client {
 	return m
 }
 
-func redisConn(conf *RedisConf) (*redis.Client, error) {
+func redisConn(conf *RedisConf) (redis.UniversalClient, error) {
+	if conf.Mode == "" {
+		conf.Mode = "single"
+	}
 
-	options := &redis.Options{
-		Addr:            fmt.Sprintf("%s:%d", conf.Host, conf.Port),
-		Password:        conf.Password,
-		DB:              conf.DB,
-		PoolSize:        conf.PoolSize,
-		MinIdleConns:    conf.MinIdleConn,
-		ConnMaxIdleTime: time.Duration(conf.ConnMaxIdleTime) * time.Second,
+	options := &redis.UniversalOptions{
+		MasterName:       conf.MasterName,
+		Username:         conf.Username,
+		Password:         conf.Password,
+		SentinelPassword: conf.SentinelPassword,
+		DB:               conf.DB,
+		Protocol:         conf.Protocol,
+		MaxRetries:       conf.MaxRetries,
+		DialTimeout:      redisTimeout(conf.DialTimeout),
+		ReadTimeout:      redisTimeout(conf.ReadTimeout),
+		WriteTimeout:     redisTimeout(conf.WriteTimeout),
+		PoolSize:         conf.PoolSize,
+		MinIdleConns:     conf.MinIdleConn,
+		ConnMaxIdleTime:  time.Duration(conf.ConnMaxIdleTime) * time.Second,
+	}
+	// 建立连接没有"不限制"的取值, 负数时 net.Dialer 会立即超时
+	if options.DialTimeout < 0 {
+		WarnF("[Redis] %s dialTimeout 不支持 %d, 使用默认值", conf.Tag, conf.DialTimeout)
+		options.DialTimeout = 0
+	}
+	switch conf.Mode {
+	case "single":
+		options.Addrs = []string{fmt.Sprintf("%s:%d", conf.Host, conf.Port)}
+	case "sentinel":
+		if conf.MasterName == "" || len(conf.SentinelAddrs) == 0 {
+			return nil, fmt.Errorf("[Redis] %s 哨兵模式需要配置 masterName 与 sentinelAddrs", conf.Tag)
+		}
+		options.Addrs = conf.SentinelAddrs
+	case "cluster":
+		if len(conf.Addrs) == 0 {
+			return nil, fmt.Errorf("[Redis] %s 集群模式需要配置 addrs", conf.Tag)
+		}
+		options.Addrs = conf.Addrs
+	default:
+		return nil, fmt.Errorf("[Redis] %s 不支持的模式 %s", conf.Tag, conf.Mode)
 	}
 
 	var (
-		sshClient *ssh.Client
-		err       error
+		dialer *sshDialer
+		err    error
 	)
 
-	if conf.IsSSH {
-		sshConfig := &ssh.ClientConfig{
-			User: conf.SSHUsername,
-			Auth: []ssh.AuthMethod{
-				ssh.Password(conf.SSHPassword),
-			},
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Timeout:         10 * time.Second,
-		}
-		sshClient, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", conf.SSHRemoteHost, conf.SSHRemotePort), sshConfig)
+	if conf.TLS != nil {
+		options.TLSConfig, err = redisTLSConfig(conf.TLS)
 		if err != nil {
-			ErrorF("Failed to dial SSH server: %v", err)
 			return nil, err
 		}
+	}
+
+	if conf.IsSSH {
+		dialer = newSshDialer(&sshConfig{
+			User:       conf.SSHUsername,
+			Password:   conf.SSHPassword,
+			PrivateKey: conf.SSHPrivateKey,
+			Passphrase: conf.SSHPassphrase,
+			RemoteHost: conf.SSHRemoteHost,
+			RemotePort: conf.SSHRemotePort,
+		})
+		// 先建立ssh连接, 认证失败时直接返回
+		if _, err = dialer.connect(); err != nil {
+			return nil, err
+		}
+
+		// 哨兵返回的主节点与集群的各节点地址都通过隧道连接
+		// 自定义 Dialer 时 go-redis 不再处理 TLS, 需要在隧道连接上握手
+		tlsConfig := options.TLSConfig
 		options.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return sshClient.Dial("tcp", fmt.Sprintf("%s:%d", conf.Host, conf.Port))
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil || tlsConfig == nil {
+				return conn, err
+			}
+			cfg := tlsConfig.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
 		}
 
-		// 禁用不适用于 SSH 隧道的超时设置, https://github.com/redis/go-redis/issues/2057
+		// 禁用不适用于 SSH 隧道的超时设置, 忽略配置的 readTimeout/writeTimeout, https://github.com/redis/go-redis/issues/2057
 		// 提到 如果使用最新版本。#2176 已修复该问题。解决办法： #2176 (comment)
 		// https://github.com/redis/go-redis/pull/2176
 		options.ReadTimeout = -2
 		options.WriteTimeout = -2
 	}
 
-	redisClient := redis.NewClient(options)
+	var redisClient redis.UniversalClient
+	switch conf.Mode {
+	case "sentinel":
+		redisClient = redis.NewFailoverClient(options.Failover())
+	case "cluster":
+		redisClient = redis.NewClusterClient(options.Cluster())
+	default:
+		redisClient = redis.NewClient(options.Simple())
+	}
 	pong, err := redisClient.Ping(context.Background()).Result()
 	if err != nil {
-		if sshClient != nil {
-			_ = sshClient.Close()
+		_ = redisClient.Close()
+		if dialer != nil {
+			_ = dialer.Close()
 		}
 		return nil, err
 	}
@@ -84,3 +150,42 @@ func redisConn(conf *RedisConf) (*redis.Client, error) {
 
 	return redisClient, nil
 }
+
+// redisTimeout 配置的毫秒数转为 go-redis 的超时, 0 使用默认值, -1 不限制, -2 不设置 deadline, 其余负数按默认值
+func redisTimeout(ms int64) time.Duration {
+	switch {
+	case ms > 0:
+		return time.Duration(ms) * time.Millisecond
+	case ms == -1, ms == -2:
+		return time.Duration(ms)
+	default:
+		return 0
+	}
+}
+
+// redisTLSConfig 根据配置的证书文件构建 tls.Config, 未配置 ca 时使用系统根证书
+func redisTLSConfig(conf *RedisTLSConf) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.SkipVerify,
+	}
+	if conf.CA != "" {
+		ca, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("[Redis] 解析CA证书失败: %s", conf.CA)
+		}
+	}
+	if conf.Cert != "" || conf.Key != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,270 @@
+package dbHelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/sync/singleflight"
+	"math/rand"
+	"time"
+)
+
+// ErrCacheMiss 缓存中没有该key
+var ErrCacheMiss = errors.New("cache miss")
+
+// ErrCacheNotFound 数据不存在, loader 返回此错误时会缓存 NegativeTTL, 避免反复穿透到数据源
+var ErrCacheNotFound = errors.New("cache: not found")
+
+// CacheCodec 缓存值的编解码
+type CacheCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JsonCodec    CacheCodec = jsonCodec{}
+	GobCodec     CacheCodec = gobCodec{} // 与 DeepCopy 相同使用 gob, 接口类型的字段需要先 gob.Register
+	MsgpackCodec CacheCodec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// 缓存值的首字节标记是正常值还是数据不存在
+const (
+	cacheFlagValue    byte = 'v'
+	cacheFlagNotFound byte = 'n'
+)
+
+// RedisCacheOptions 缓存参数
+type RedisCacheOptions struct {
+	Codec       CacheCodec    // 编解码 默认 JsonCodec
+	Prefix      string        // key前缀, 默认为 SetAppName 设置的项目名称, 完整key为 {prefix}:{key}
+	Jitter      float64       // 过期时间随机增加的比例 0~1, 避免同时过期 默认0.1, 小于0不增加
+	NegativeTTL time.Duration // 数据不存在时的缓存时间 默认1分钟, 小于0不缓存
+}
+
+// RedisCache 类型化的旁路缓存, 并发的相同 GetOrLoad 只会调用一次 loader
+type RedisCache[T any] struct {
+	tag   string
+	opt   RedisCacheOptions
+	group singleflight.Group
+}
+
+// NewRedisCache 在redis标记上创建缓存, opt 为 nil 时使用默认参数
+func NewRedisCache[T any](tag string, opt *RedisCacheOptions) *RedisCache[T] {
+	c := &RedisCache[T]{tag: tag}
+	if opt != nil {
+		c.opt = *opt
+	}
+	if c.opt.Codec == nil {
+		c.opt.Codec = JsonCodec
+	}
+	if c.opt.Prefix == "" {
+		c.opt.Prefix = std.appName
+	}
+	if c.opt.Jitter == 0 {
+		c.opt.Jitter = 0.1
+	}
+	if c.opt.NegativeTTL == 0 {
+		c.opt.NegativeTTL = time.Minute
+	}
+	return c
+}
+
+func (c *RedisCache[T]) redis() redis.UniversalClient {
+	return GetRedisConn(c.tag)
+}
+
+func (c *RedisCache[T]) key(key string) string {
+	if c.opt.Prefix == "" {
+		return key
+	}
+	return c.opt.Prefix + ":" + key
+}
+
+// ttl 按 Jitter 随机延长过期时间
+func (c *RedisCache[T]) ttl(ttl time.Duration) time.Duration {
+	if ttl <= 0 || c.opt.Jitter <= 0 {
+		return ttl
+	}
+	if n := int64(float64(ttl) * c.opt.Jitter); n > 0 {
+		ttl += time.Duration(rand.Int63n(n))
+	}
+	return ttl
+}
+
+func (c *RedisCache[T]) encode(v T) ([]byte, error) {
+	b, err := c.opt.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{cacheFlagValue}, b...), nil
+}
+
+func (c *RedisCache[T]) decode(data []byte) (T, error) {
+	var v T
+	if len(data) == 0 {
+		return v, ErrCacheMiss
+	}
+	if data[0] == cacheFlagNotFound {
+		return v, ErrCacheNotFound
+	}
+	err := c.opt.Codec.Unmarshal(data[1:], &v)
+	return v, err
+}
+
+// Get 读取缓存, 不存在返回 ErrCacheMiss, 缓存了数据不存在时返回 ErrCacheNotFound
+func (c *RedisCache[T]) Get(ctx context.Context, key string) (T, error) {
+	b, err := c.redis().Get(ctx, c.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		var v T
+		return v, ErrCacheMiss
+	}
+	if err != nil {
+		var v T
+		return v, err
+	}
+	return c.decode(b)
+}
+
+// Set 写入缓存, ttl 为0表示不过期
+func (c *RedisCache[T]) Set(ctx context.Context, key string, value T, ttl time.Duration) error {
+	b, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.redis().Set(ctx, c.key(key), b, c.ttl(ttl)).Err()
+}
+
+// SetNotFound 缓存数据不存在, 有效期为 NegativeTTL
+func (c *RedisCache[T]) SetNotFound(ctx context.Context, key string) error {
+	if c.opt.NegativeTTL < 0 {
+		return nil
+	}
+	return c.redis().Set(ctx, c.key(key), []byte{cacheFlagNotFound}, c.ttl(c.opt.NegativeTTL)).Err()
+}
+
+func (c *RedisCache[T]) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	// 集群模式下多个key可能不在同一个slot, 逐个删除
+	pipe := c.redis().Pipeline()
+	for _, k := range keys {
+		pipe.Del(ctx, c.key(k))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetOrLoad 读取缓存, 未命中时调用 loader 加载并写入缓存
+// loader 返回 ErrCacheNotFound 时缓存数据不存在并返回该错误, 返回其他错误时不缓存
+func (c *RedisCache[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	v, err := c.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrCacheNotFound) {
+		return v, err
+	}
+	if !errors.Is(err, ErrCacheMiss) {
+		WarnF("[RedisCache] 读取缓存失败 key = %s err = %v", key, err)
+	}
+	return c.load(ctx, key, ttl, loader)
+}
+
+// load 调用 loader 并写入缓存, 同一个key并发时只调用一次
+func (c *RedisCache[T]) load(ctx context.Context, key string, ttl time.Duration, loader func(ctx context.Context) (T, error)) (T, error) {
+	res, err, _ := c.group.Do(key, func() (interface{}, error) {
+		v, err := loader(ctx)
+		if errors.Is(err, ErrCacheNotFound) {
+			if err := c.SetNotFound(ctx, key); err != nil {
+				WarnF("[RedisCache] 写入缓存失败 key = %s err = %v", key, err)
+			}
+			return v, err
+		}
+		if err != nil {
+			return v, err
+		}
+		if err := c.Set(ctx, key, v, ttl); err != nil {
+			WarnF("[RedisCache] 写入缓存失败 key = %s err = %v", key, err)
+		}
+		return v, nil
+	})
+	v, _ := res.(T)
+	return v, err
+}
+
+// MGet 批量读取, 返回命中的 key -> 值, 未命中与缓存了数据不存在的key不在结果中
+func (c *RedisCache[T]) MGet(ctx context.Context, keys []string) (map[string]T, error) {
+	result := make(map[string]T, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	// 集群模式下 MGET 要求key在同一个slot, 使用 pipeline 逐个读取
+	pipe := c.redis().Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, k := range keys {
+		cmds[i] = pipe.Get(ctx, c.key(k))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		b, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+		v, err := c.decode(b)
+		if errors.Is(err, ErrCacheNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[keys[i]] = v
+	}
+	return result, nil
+}
+
+// MSet 批量写入, 每个key的过期时间单独计算抖动
+func (c *RedisCache[T]) MSet(ctx context.Context, values map[string]T, ttl time.Duration) error {
+	if len(values) == 0 {
+		return nil
+	}
+	pipe := c.redis().Pipeline()
+	for k, v := range values {
+		b, err := c.encode(v)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, c.key(k), b, c.ttl(ttl))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,244 @@
+package dbHelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 加锁成功时递增并返回 fencing token, 锁已被持有时返回0
+var redisLockAcquireScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+// 只有持有者才能释放
+var redisLockReleaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// 只有持有者才能续期
+var redisLockExtendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// RedisMutex redis分布式锁, 持有期间由看门狗每 ttl/3 续期一次, 续期失败(锁已丢失)时关闭 Lost 返回的通道
+// 锁key为 dbHelper:lock:{key}, 集群模式下 fencing token 计数器与锁在同一个slot
+type RedisMutex struct {
+	tags   []string
+	key    string
+	ttl    time.Duration
+	quorum int
+	mux    sync.Mutex
+	value  string
+	token  int64
+	held   bool
+	stop   context.CancelFunc
+	lost   chan struct{}
+}
+
+// RedisLock 在redis标记上创建锁, ttl 为锁的过期时间, 持有期间自动续期
+func RedisLock(tag, key string, ttl time.Duration) *RedisMutex {
+	return RedisRedlock([]string{tag}, key, ttl)
+}
+
+// RedisRedlock 在多个相互独立的redis标记上创建锁(Redlock), 超过半数加锁成功才算持有
+// fencing token 取各节点计数器的最大值, 节点故障时不保证严格递增; ttl 为0时默认30秒, 不能小于1毫秒
+func RedisRedlock(tags []string, key string, ttl time.Duration) *RedisMutex {
+	if len(tags) == 0 {
+		panic("[RedisLock] 未指定redis标记")
+	}
+	for _, tag := range tags {
+		GetRedisConn(tag)
+	}
+	if ttl == 0 {
+		ttl = 30 * time.Second
+	}
+	if ttl < time.Millisecond {
+		panic(fmt.Sprintf("[RedisLock] %s ttl 不能小于1毫秒: %v", key, ttl))
+	}
+	return &RedisMutex{tags: tags, key: key, ttl: ttl, quorum: len(tags)/2 + 1}
+}
+
+func (m *RedisMutex) lockKey() string {
+	return "dbHelper:lock:{" + m.key + "}"
+}
+
+func (m *RedisMutex) fenceKey() string {
+	return "dbHelper:lock:{" + m.key + "}:fence"
+}
+
+// Lock 阻塞直到获取锁或 ctx 结束
+func (m *RedisMutex) Lock(ctx context.Context) error {
+	for {
+		ok, err := m.TryLock(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		wait := 50*time.Millisecond + time.Duration(rand.Int63n(int64(100*time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// TryLock 尝试获取一次锁, 锁被其他持有者占用时返回 false
+func (m *RedisMutex) TryLock(ctx context.Context) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.held {
+		return false, fmt.Errorf("[RedisLock] %s 已被当前实例持有", m.key)
+	}
+
+	value := GetUUID()
+	start := time.Now()
+	var (
+		acquired int
+		token    int64
+		lastErr  error
+	)
+	for _, tag := range m.tags {
+		n, err := redisLockAcquireScript.Run(ctx, GetRedisConn(tag), []string{m.lockKey(), m.fenceKey()},
+			value, m.ttl.Milliseconds()).Int64()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if n > 0 {
+			acquired++
+			if n > token {
+				token = n
+			}
+		}
+	}
+
+	// 时钟漂移按 ttl 的1%加2ms估算, 剩余有效期不足时视为失败
+	validity := m.ttl - time.Since(start) - m.ttl/100 - 2*time.Millisecond
+	if acquired < m.quorum || validity <= 0 {
+		m.release(context.WithoutCancel(ctx), value)
+		if acquired == 0 && lastErr != nil && len(m.tags) == 1 {
+			return false, lastErr
+		}
+		return false, nil
+	}
+
+	m.value = value
+	m.token = token
+	m.held = true
+	m.lost = make(chan struct{})
+	watchCtx, stop := context.WithCancel(context.Background())
+	m.stop = stop
+	go m.watchdog(watchCtx, value, m.lost)
+	return true, nil
+}
+
+// Unlock 释放锁, 当前实例未持有或锁已丢失时返回 ErrLockNotHeld
+// 取消看门狗的 context 使正在进行的续期立即返回, 不等待看门狗退出
+func (m *RedisMutex) Unlock(ctx context.Context) error {
+	m.mux.Lock()
+	if !m.held {
+		m.mux.Unlock()
+		return ErrLockNotHeld
+	}
+	value := m.value
+	m.held = false
+	m.lost = nil
+	m.stop()
+	m.mux.Unlock()
+
+	if released := m.release(ctx, value); released < m.quorum {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Token 当前持有锁的 fencing token, 每次加锁递增, 写入下游时携带以拒绝过期持有者的请求
+func (m *RedisMutex) Token() int64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.token
+}
+
+// Lost 锁因续期失败丢失时关闭, 丢失后调用返回已关闭的通道; 从未加锁或已通过 Unlock 正常释放时返回 nil
+func (m *RedisMutex) Lost() <-chan struct{} {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.lost
+}
+
+// release 在所有标记上释放 value 持有的锁, 返回成功释放的节点数
+func (m *RedisMutex) release(ctx context.Context, value string) int {
+	released := 0
+	for _, tag := range m.tags {
+		n, err := redisLockReleaseScript.Run(ctx, GetRedisConn(tag), []string{m.lockKey()}, value).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			WarnF("[RedisLock] 释放锁 %s 失败 tag = %s err = %v", m.key, tag, err)
+			continue
+		}
+		if n > 0 {
+			released++
+		}
+	}
+	return released
+}
+
+// watchdog 每 ttl/3 续期, 续期成功的节点不足半数时认为锁已丢失, ctx 在 Unlock 时取消
+func (m *RedisMutex) watchdog(ctx context.Context, value string, lost chan struct{}) {
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		extended := 0
+		for _, tag := range m.tags {
+			extendCtx, cancel := context.WithTimeout(ctx, m.ttl/3)
+			n, err := redisLockExtendScript.Run(extendCtx, GetRedisConn(tag), []string{m.lockKey()}, value, m.ttl.Milliseconds()).Int64()
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				WarnF("[RedisLock] 续期锁 %s 失败 tag = %s err = %v", m.key, tag, err)
+				continue
+			}
+			if n > 0 {
+				extended++
+			}
+		}
+		if extended >= m.quorum {
+			continue
+		}
+
+		ErrorF("[RedisLock] 锁 %s 已丢失", m.key)
+		m.mux.Lock()
+		if m.value == value && m.held {
+			m.held = false
+			m.stop()
+		}
+		// 在锁内关闭, 之后调用 Lost 得到的一定是已关闭的通道
+		close(lost)
+		m.mux.Unlock()
+		return
+	}
+}
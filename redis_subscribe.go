@@ -0,0 +1,267 @@
+package dbHelper
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RedisMessage 订阅收到的消息, 按模式订阅时 Pattern 为匹配的模式
+type RedisMessage struct {
+	Channel string
+	Pattern string
+	Payload string
+}
+
+// RedisMessageHandler 处理订阅消息, 返回的错误只记录日志
+type RedisMessageHandler func(ctx context.Context, msg *RedisMessage) error
+
+// RedisTypedHandler 把消息解码为 T 后交给 handler, codec 为 nil 时使用 JsonCodec, 解码失败的消息记录日志后丢弃
+func RedisTypedHandler[T any](codec CacheCodec, handler func(ctx context.Context, msg *RedisMessage, v T) error) RedisMessageHandler {
+	if codec == nil {
+		codec = JsonCodec
+	}
+	return func(ctx context.Context, msg *RedisMessage) error {
+		var v T
+		if err := codec.Unmarshal([]byte(msg.Payload), &v); err != nil {
+			return fmt.Errorf("解码消息失败: %w", err)
+		}
+		return handler(ctx, msg, v)
+	}
+}
+
+// RedisSubscribeOptions 订阅参数
+type RedisSubscribeOptions struct {
+	Concurrency int    // 同时处理的消息数 默认10
+	Ordered     bool   // 同一个频道的消息按收到的顺序逐条处理, 不同频道之间仍并发
+	BufferSize  int    // 等待处理的消息数, 处理不过来时停止读取, 积压过多时redis会断开订阅连接 默认1000
+	OnReconnect func() // 断开后重新订阅成功时调用, 断开期间发布的消息已丢失, 可在此重新同步数据
+}
+
+// RedisSubscriber 订阅, ctx 结束或调用 Close 时停止
+type RedisSubscriber struct {
+	tag      string
+	opt      RedisSubscribeOptions
+	handler  RedisMessageHandler
+	client   redis.UniversalClient
+	names    []string
+	channels []string
+	patterns []string
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// RedisSubscribe 使用默认参数订阅频道, 包含 * ? [ 的按模式订阅(PSUBSCRIBE), 见 RedisSubscribeWith
+func RedisSubscribe(ctx context.Context, tag string, handler RedisMessageHandler, channels ...string) (*RedisSubscriber, error) {
+	return RedisSubscribeWith(ctx, tag, nil, handler, channels...)
+}
+
+// RedisSubscribeWith 订阅频道并并发调用 handler, 连接断开后自动重连并重新订阅(包括ssh隧道)
+// pub/sub 不保存消息, 断开期间发布的消息会丢失, 需要可靠投递时使用 StreamWorker
+func RedisSubscribeWith(ctx context.Context, tag string, opt *RedisSubscribeOptions, handler RedisMessageHandler, channels ...string) (*RedisSubscriber, error) {
+	client, ok := RedisConn[tag]
+	if !ok {
+		return nil, fmt.Errorf("[RedisSubscribe] redis标记 %s 未init", tag)
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("[RedisSubscribe] 未指定频道")
+	}
+
+	s := &RedisSubscriber{tag: tag, handler: handler, client: client, names: channels, done: make(chan struct{})}
+	if opt != nil {
+		s.opt = *opt
+	}
+	if s.opt.Concurrency < 1 {
+		s.opt.Concurrency = 10
+	}
+	if s.opt.BufferSize < 1 {
+		s.opt.BufferSize = 1000
+	}
+	for _, ch := range channels {
+		if strings.ContainsAny(ch, "*?[") {
+			s.patterns = append(s.patterns, ch)
+		} else {
+			s.channels = append(s.channels, ch)
+		}
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx)
+	return s, nil
+}
+
+// Close 停止订阅, 等待处理中的消息完成, 未开始处理的消息被丢弃
+func (s *RedisSubscriber) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Done 订阅停止且所有 handler 返回后关闭
+func (s *RedisSubscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *RedisSubscriber) run(ctx context.Context) {
+	defer close(s.done)
+
+	// Ordered 时每个处理协程一个队列, 同一个频道总是进入同一个队列
+	queues := make([]chan *RedisMessage, 1)
+	if s.opt.Ordered {
+		queues = make([]chan *RedisMessage, s.opt.Concurrency)
+	}
+	for i := range queues {
+		queues[i] = make(chan *RedisMessage, s.opt.BufferSize/len(queues)+1)
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < s.opt.Concurrency; i++ {
+		queue := queues[i%len(queues)]
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				s.call(ctx, msg)
+			}
+		}()
+	}
+
+	s.receive(ctx, queues)
+
+	for _, q := range queues {
+		close(q)
+	}
+	workers.Wait()
+	InfoF("[RedisSubscribe] %s 已停止订阅 %v", s.tag, s.names)
+}
+
+// 订阅连接每隔 redisSubscribePing 发送一次 PING, 超过两个间隔没有收到任何回复时认为连接已断开
+const redisSubscribePing = 10 * time.Second
+
+// receive 读取消息直到 ctx 结束, 断开后关闭订阅连接, 1秒后重新订阅
+func (s *RedisSubscriber) receive(ctx context.Context, queues []chan *RedisMessage) {
+	subscribed := false
+	for {
+		err := s.receiveOnce(ctx, queues, &subscribed)
+		if ctx.Err() != nil {
+			return
+		}
+		ErrorF("[RedisSubscribe] %s 订阅连接断开, 1秒后重新订阅: %v", s.tag, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// receiveOnce 在一个订阅连接上读取消息, 返回连接断开的原因
+// 读取不设置超时, ssh隧道的连接不支持 SetDeadline; 由另一个协程定期 PING, 长时间没有回复或 ctx 结束时关闭连接打断读取
+func (s *RedisSubscriber) receiveOnce(ctx context.Context, queues []chan *RedisMessage, subscribed *bool) error {
+	ps := s.client.Subscribe(ctx)
+	defer func() {
+		_ = ps.Close()
+	}()
+	if len(s.channels) > 0 {
+		if err := ps.Subscribe(ctx, s.channels...); err != nil {
+			return err
+		}
+	}
+	if len(s.patterns) > 0 {
+		if err := ps.PSubscribe(ctx, s.patterns...); err != nil {
+			return err
+		}
+	}
+
+	var (
+		lastReply atomic.Int64
+		blocked   atomic.Bool // 等待处理队列时不读取连接, 不检查回复
+		timedOut  atomic.Bool
+	)
+	lastReply.Store(time.Now().UnixNano())
+	pingCtx, stopPing := context.WithCancel(ctx)
+	defer stopPing()
+	go func() {
+		ticker := time.NewTicker(redisSubscribePing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingCtx.Done():
+				_ = ps.Close()
+				return
+			case <-ticker.C:
+			}
+			if blocked.Load() {
+				lastReply.Store(time.Now().UnixNano())
+				continue
+			}
+			if time.Since(time.Unix(0, lastReply.Load())) > 2*redisSubscribePing {
+				timedOut.Store(true)
+				_ = ps.Close()
+				return
+			}
+			_ = ps.Ping(pingCtx)
+		}
+	}()
+
+	connected := false
+	for {
+		msg, err := ps.ReceiveTimeout(ctx, -1)
+		if err != nil {
+			if timedOut.Load() {
+				return fmt.Errorf("%v 内未收到 PING 的回复", 2*redisSubscribePing)
+			}
+			return err
+		}
+		lastReply.Store(time.Now().UnixNano())
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if connected || (m.Kind != "subscribe" && m.Kind != "psubscribe") {
+				continue
+			}
+			connected = true
+			if !*subscribed {
+				*subscribed = true
+				InfoF("[RedisSubscribe] %s 已订阅 %v", s.tag, s.names)
+				continue
+			}
+			InfoF("[RedisSubscribe] %s 已重新订阅 %v", s.tag, s.names)
+			if s.opt.OnReconnect != nil {
+				s.opt.OnReconnect()
+			}
+		case *redis.Message:
+			queue := queues[0]
+			if len(queues) > 1 {
+				h := fnv.New32a()
+				_, _ = h.Write([]byte(m.Channel))
+				queue = queues[h.Sum32()%uint32(len(queues))]
+			}
+			blocked.Store(true)
+			select {
+			case queue <- &RedisMessage{Channel: m.Channel, Pattern: m.Pattern, Payload: m.Payload}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			blocked.Store(false)
+			lastReply.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+func (s *RedisSubscriber) call(ctx context.Context, msg *RedisMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			ErrorF("[RedisSubscribe] %s 处理频道 %s 的消息 panic: %v", s.tag, msg.Channel, r)
+		}
+	}()
+	if err := s.handler(ctx, msg); err != nil {
+		WarnF("[RedisSubscribe] %s 处理频道 %s 的消息失败: %v", s.tag, msg.Channel, err)
+	}
+}
@@ -0,0 +1,208 @@
+package dbHelper
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var ShardGroups map[string]*ShardGroup
+
+// ShardGroup 分片组, 按分片键将请求路由到组内的mysql标记
+type ShardGroup struct {
+	conf  *ShardConf
+	ring  []uint32          // 一致性哈希环
+	nodes map[uint32]string // 哈希环节点 -> mysql标记
+}
+
+func initShardGroups() {
+	ShardGroups = make(map[string]*ShardGroup, len(Conf.ShardConf))
+	for _, v := range Conf.ShardConf {
+		g, err := newShardGroup(v)
+		if err != nil {
+			panic(err)
+		}
+		ShardGroups[v.Group] = g
+	}
+}
+
+func newShardGroup(conf *ShardConf) (*ShardGroup, error) {
+	g := &ShardGroup{conf: conf}
+
+	tags := conf.Tags
+	if conf.Strategy == "range" {
+		tags = make([]string, 0, len(conf.Ranges))
+		for _, r := range conf.Ranges {
+			tags = append(tags, r.Tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("[Shard] 分片组 %s 未配置分片", conf.Group)
+	}
+	for _, tag := range tags {
+		if _, ok := MysqlConn[tag]; !ok {
+			return nil, fmt.Errorf("[Shard] 分片组 %s 的mysql标记 %s 未init", conf.Group, tag)
+		}
+	}
+
+	switch conf.Strategy {
+	case "", "mod":
+		conf.Strategy = "mod"
+	case "consistent":
+		if conf.VirtualNodes < 1 {
+			conf.VirtualNodes = 160
+		}
+		g.nodes = make(map[uint32]string, len(tags)*conf.VirtualNodes)
+		for _, tag := range tags {
+			for i := 0; i < conf.VirtualNodes; i++ {
+				h := crc32.ChecksumIEEE([]byte(tag + "#" + strconv.Itoa(i)))
+				g.nodes[h] = tag
+				g.ring = append(g.ring, h)
+			}
+		}
+		sort.Slice(g.ring, func(i, j int) bool { return g.ring[i] < g.ring[j] })
+	case "range":
+	default:
+		return nil, fmt.Errorf("[Shard] 分片组 %s 不支持的分片策略 %s", conf.Group, conf.Strategy)
+	}
+
+	InfoF("[Shard] 分片组 %s 策略 %s 分片 %v", conf.Group, conf.Strategy, tags)
+	return g, nil
+}
+
+func GetShardGroup(group string) *ShardGroup {
+	g, ok := ShardGroups[group]
+	if !ok {
+		panic("[Shard] 未init")
+	}
+	return g
+}
+
+// ShardDB 通过分片键获取所在分片的连接
+func ShardDB(group string, key interface{}) *gorm.DB {
+	tag, err := GetShardGroup(group).Tag(key)
+	if err != nil {
+		panic(err)
+	}
+	return GetMysqlConn(tag)
+}
+
+// Tag 分片键所在分片的mysql标记
+func (g *ShardGroup) Tag(key interface{}) (string, error) {
+	switch g.conf.Strategy {
+	case "consistent":
+		h := crc32.ChecksumIEEE([]byte(AnyToString(key)))
+		i := sort.Search(len(g.ring), func(i int) bool { return g.ring[i] >= h })
+		if i == len(g.ring) {
+			i = 0
+		}
+		return g.nodes[g.ring[i]], nil
+
+	case "range":
+		n, ok := shardKeyInt(key)
+		if !ok {
+			return "", fmt.Errorf("[Shard] 分片组 %s 范围分片键必须是整数: %v", g.conf.Group, key)
+		}
+		for _, r := range g.conf.Ranges {
+			if n >= r.Start && (r.End == 0 || n < r.End) {
+				return r.Tag, nil
+			}
+		}
+		return "", fmt.Errorf("[Shard] 分片组 %s 分片键 %d 不在任何范围内", g.conf.Group, n)
+
+	default:
+		// 整数分片键直接取模, 其余先做哈希
+		n, ok := shardKeyInt(key)
+		if !ok {
+			n = int64(crc32.ChecksumIEEE([]byte(AnyToString(key))))
+		}
+		i := n % int64(len(g.conf.Tags))
+		if i < 0 {
+			i = -i
+		}
+		return g.conf.Tags[i], nil
+	}
+}
+
+// Tags 分片组内全部的mysql标记
+func (g *ShardGroup) Tags() []string {
+	if g.conf.Strategy != "range" {
+		return g.conf.Tags
+	}
+	tags := make([]string, 0, len(g.conf.Ranges))
+	for _, r := range g.conf.Ranges {
+		if !SliceContains(tags, r.Tag) {
+			tags = append(tags, r.Tag)
+		}
+	}
+	return tags
+}
+
+// shardKeyInt 整数分片键转为 int64; 超出 int64 范围的无符号数不当作整数, 取模策略按字符串哈希, 范围策略返回错误, 避免溢出为负数后路由到错误的分片
+func shardKeyInt(key interface{}) (int64, bool) {
+	switch v := key.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), uint64(v) <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// ShardGather 在分片组的所有分片上并发执行查询并合并结果
+// query 在每个分片上执行, 应自行带上排序与 limit; less 非空时按其对合并结果排序, limit 大于0时截取前 limit 条
+func ShardGather[T any](ctx context.Context, group string, query func(db *gorm.DB) ([]T, error),
+	less func(a, b T) bool, limit int) ([]T, error) {
+
+	tags := GetShardGroup(group).Tags()
+	var (
+		wg      sync.WaitGroup
+		results = make([][]T, len(tags))
+		errs    = make([]error, len(tags))
+	)
+	for i, tag := range tags {
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			results[i], errs[i] = query(GetMysqlConn(tag).WithContext(ctx))
+		}(i, tag)
+	}
+	wg.Wait()
+
+	list := make([]T, 0)
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("[Shard] 分片 %s 查询失败: %w", tags[i], err)
+		}
+		list = append(list, results[i]...)
+	}
+
+	if less != nil {
+		sort.SliceStable(list, func(i, j int) bool { return less(list[i], list[j]) })
+	}
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
@@ -0,0 +1,459 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SqlExpr 原样写入sql的表达式, 不作为参数绑定, 如 Set("updated_at", SqlExpr("now()"))
+type SqlExpr string
+
+type sqlBuilderKind int
+
+const (
+	builderSelect sqlBuilderKind = iota
+	builderInsert
+	builderUpdate
+	builderUpsert
+	builderDelete
+)
+
+type sqlCond struct {
+	or   bool
+	expr string
+	args []interface{}
+}
+
+type sqlSet struct {
+	column string
+	value  interface{}
+}
+
+// SqlBuilder 简单的sql构建器, 条件中使用 ? 作为占位符, 构建时按方言转换为 ? 或 $n
+// 一个构建器对应一条语句, 不是并发安全的
+type SqlBuilder struct {
+	db        *sql.DB
+	dialect   sqlDialect
+	kind      sqlBuilderKind
+	table     string
+	columns   []string
+	sets      []sqlSet
+	conflict  []string
+	where     []sqlCond
+	orderBy   []string
+	limit     int64
+	offset    int64
+	returning []string
+	err       error
+}
+
+// NewSqlBuilder 通过mysql或pgsql标记创建构建器, 可直接使用 Maps/Exec 执行
+func NewSqlBuilder(tag string) *SqlBuilder {
+	db, dialect, err := getSqlDB(tag)
+	return &SqlBuilder{db: db, dialect: dialect, err: err}
+}
+
+// NewMysqlBuilder 只用于构建mysql语句, 不绑定连接
+func NewMysqlBuilder() *SqlBuilder {
+	return &SqlBuilder{dialect: dialectMysql}
+}
+
+// NewPgsqlBuilder 只用于构建pgsql语句, 不绑定连接
+func NewPgsqlBuilder() *SqlBuilder {
+	return &SqlBuilder{dialect: dialectPostgres}
+}
+
+// Select 查询的列, 不传为 *, 普通列名会加引号, 表达式原样保留
+func (b *SqlBuilder) Select(columns ...string) *SqlBuilder {
+	b.kind = builderSelect
+	b.columns = append(b.columns, columns...)
+	return b
+}
+
+func (b *SqlBuilder) From(table string) *SqlBuilder {
+	b.table = table
+	return b
+}
+
+// Insert 插入, 通过 Set/SetMap 设置列与值
+func (b *SqlBuilder) Insert(table string) *SqlBuilder {
+	b.kind = builderInsert
+	b.table = table
+	return b
+}
+
+// Update 更新, 通过 Set/SetMap 设置列与值, 必须有 Where 条件
+func (b *SqlBuilder) Update(table string) *SqlBuilder {
+	b.kind = builderUpdate
+	b.table = table
+	return b
+}
+
+// Upsert 插入, conflictColumns 冲突时更新 Set 中除冲突列以外的列
+// pgsql 为 ON CONFLICT ... DO UPDATE, mysql 为 ON DUPLICATE KEY UPDATE (由唯一索引判断冲突, 忽略 conflictColumns)
+func (b *SqlBuilder) Upsert(table string, conflictColumns ...string) *SqlBuilder {
+	b.kind = builderUpsert
+	b.table = table
+	b.conflict = conflictColumns
+	return b
+}
+
+// Delete 删除, 必须有 Where 条件
+func (b *SqlBuilder) Delete(table string) *SqlBuilder {
+	b.kind = builderDelete
+	b.table = table
+	return b
+}
+
+// Set 设置插入或更新的列, 按调用顺序输出
+func (b *SqlBuilder) Set(column string, value interface{}) *SqlBuilder {
+	b.sets = append(b.sets, sqlSet{column: column, value: value})
+	return b
+}
+
+// SetMap 按列名排序设置插入或更新的列
+func (b *SqlBuilder) SetMap(values map[string]interface{}) *SqlBuilder {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.Set(k, values[k])
+	}
+	return b
+}
+
+// Where 添加 AND 条件, 如 Where("status = ? AND age > ?", 1, 18)
+func (b *SqlBuilder) Where(expr string, args ...interface{}) *SqlBuilder {
+	b.where = append(b.where, sqlCond{expr: expr, args: args})
+	return b
+}
+
+// And 同 Where
+func (b *SqlBuilder) And(expr string, args ...interface{}) *SqlBuilder {
+	return b.Where(expr, args...)
+}
+
+// Or 添加 OR 条件, 每个条件都带括号, 按sql优先级 AND 先于 OR
+func (b *SqlBuilder) Or(expr string, args ...interface{}) *SqlBuilder {
+	b.where = append(b.where, sqlCond{or: true, expr: expr, args: args})
+	return b
+}
+
+// In 添加 column IN (...) 条件, values 为空时条件恒为假
+func (b *SqlBuilder) In(column string, values ...interface{}) *SqlBuilder {
+	if len(values) == 0 {
+		return b.Where("1 = 0")
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	return b.Where(b.ident(column)+" IN ("+marks+")", values...)
+}
+
+// OrderBy 排序, 如 OrderBy("created_at DESC", "id")
+func (b *SqlBuilder) OrderBy(exprs ...string) *SqlBuilder {
+	for _, e := range exprs {
+		fields := strings.Fields(e)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = b.ident(fields[0])
+		b.orderBy = append(b.orderBy, strings.Join(fields, " "))
+	}
+	return b
+}
+
+func (b *SqlBuilder) Limit(n int64) *SqlBuilder {
+	b.limit = n
+	return b
+}
+
+func (b *SqlBuilder) Offset(n int64) *SqlBuilder {
+	b.offset = n
+	return b
+}
+
+// Returning 返回插入、更新或删除的行, 仅pgsql支持
+func (b *SqlBuilder) Returning(columns ...string) *SqlBuilder {
+	b.returning = append(b.returning, columns...)
+	return b
+}
+
+// Err 构建过程中的错误, Build 出错时返回空语句
+func (b *SqlBuilder) Err() error {
+	return b.err
+}
+
+// Build 生成sql语句与参数, 可用于日志或传给 QueryMaps/QueryStructs
+func (b *SqlBuilder) Build() (string, []interface{}) {
+	if b.err != nil {
+		return "", nil
+	}
+	w := &sqlBuildWriter{dialect: b.dialect}
+	if b.table == "" {
+		b.err = fmt.Errorf("[SqlBuilder] 未指定表")
+		return "", nil
+	}
+	if len(b.returning) > 0 && b.dialect != dialectPostgres {
+		b.err = fmt.Errorf("[SqlBuilder] %s 不支持 RETURNING", b.dialect)
+		return "", nil
+	}
+
+	switch b.kind {
+	case builderSelect:
+		columns := make([]string, len(b.columns))
+		for i, c := range b.columns {
+			columns[i] = b.ident(c)
+		}
+		if len(columns) == 0 {
+			columns = []string{"*"}
+		}
+		w.WriteString("SELECT " + strings.Join(columns, ", ") + " FROM " + b.ident(b.table))
+		b.writeWhere(w)
+		if len(b.orderBy) > 0 {
+			w.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+		}
+		if b.limit > 0 {
+			w.WriteString(" LIMIT " + strconv.FormatInt(b.limit, 10))
+		}
+		if b.offset > 0 {
+			w.WriteString(" OFFSET " + strconv.FormatInt(b.offset, 10))
+		}
+
+	case builderInsert, builderUpsert:
+		if len(b.sets) == 0 {
+			b.err = fmt.Errorf("[SqlBuilder] INSERT 未设置列")
+			return "", nil
+		}
+		columns := make([]string, len(b.sets))
+		for i, s := range b.sets {
+			columns[i] = b.ident(s.column)
+		}
+		w.WriteString("INSERT INTO " + b.ident(b.table) + " (" + strings.Join(columns, ", ") + ") VALUES (")
+		for i, s := range b.sets {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.value(s.value)
+		}
+		w.WriteString(")")
+		if b.kind == builderUpsert {
+			if err := b.writeUpsert(w); err != nil {
+				b.err = err
+				return "", nil
+			}
+		}
+
+	case builderUpdate:
+		if len(b.sets) == 0 {
+			b.err = fmt.Errorf("[SqlBuilder] UPDATE 未设置列")
+			return "", nil
+		}
+		if len(b.where) == 0 {
+			b.err = fmt.Errorf("[SqlBuilder] UPDATE 缺少 WHERE 条件")
+			return "", nil
+		}
+		w.WriteString("UPDATE " + b.ident(b.table) + " SET ")
+		for i, s := range b.sets {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.WriteString(b.ident(s.column) + " = ")
+			w.value(s.value)
+		}
+		b.writeWhere(w)
+
+	case builderDelete:
+		if len(b.where) == 0 {
+			b.err = fmt.Errorf("[SqlBuilder] DELETE 缺少 WHERE 条件")
+			return "", nil
+		}
+		w.WriteString("DELETE FROM " + b.ident(b.table))
+		b.writeWhere(w)
+	}
+
+	if len(b.returning) > 0 && b.kind != builderSelect {
+		columns := make([]string, len(b.returning))
+		for i, c := range b.returning {
+			columns[i] = b.ident(c)
+		}
+		w.WriteString(" RETURNING " + strings.Join(columns, ", "))
+	}
+
+	if w.err != nil {
+		b.err = w.err
+		return "", nil
+	}
+	return w.String(), w.args
+}
+
+// Maps 执行查询并将每行转换为 map, 见 QueryMaps
+func (b *SqlBuilder) Maps(ctx context.Context) ([]map[string]interface{}, error) {
+	query, args, err := b.prepare()
+	if err != nil {
+		return nil, err
+	}
+	return QueryMaps(ctx, b.db, query, args...)
+}
+
+// Exec 执行插入、更新或删除
+func (b *SqlBuilder) Exec(ctx context.Context) (sql.Result, error) {
+	query, args, err := b.prepare()
+	if err != nil {
+		return nil, err
+	}
+	return b.db.ExecContext(ctx, query, args...)
+}
+
+// BuilderStructs 执行构建器生成的查询并将每行映射到结构体 T (或 *T), 见 QueryStructs
+func BuilderStructs[T any](ctx context.Context, b *SqlBuilder) ([]T, error) {
+	query, args, err := b.prepare()
+	if err != nil {
+		return nil, err
+	}
+	return QueryStructs[T](ctx, b.db, query, args...)
+}
+
+// BuilderOne 执行构建器生成的查询并将第一行映射到结构体 T (或 *T), 没有数据时返回 sql.ErrNoRows
+func BuilderOne[T any](ctx context.Context, b *SqlBuilder) (T, error) {
+	query, args, err := b.prepare()
+	if err != nil {
+		var item T
+		return item, err
+	}
+	return QueryOne[T](ctx, b.db, query, args...)
+}
+
+func (b *SqlBuilder) prepare() (string, []interface{}, error) {
+	query, args := b.Build()
+	if b.err != nil {
+		return "", nil, b.err
+	}
+	if b.db == nil {
+		return "", nil, errors.New("[SqlBuilder] 未绑定连接, 请使用 NewSqlBuilder(tag) 创建")
+	}
+	return query, args, nil
+}
+
+func (b *SqlBuilder) writeWhere(w *sqlBuildWriter) {
+	for i, c := range b.where {
+		switch {
+		case i == 0:
+			w.WriteString(" WHERE ")
+		case c.or:
+			w.WriteString(" OR ")
+		default:
+			w.WriteString(" AND ")
+		}
+		if len(b.where) > 1 {
+			w.WriteString("(")
+		}
+		w.bind(c.expr, c.args)
+		if len(b.where) > 1 {
+			w.WriteString(")")
+		}
+	}
+}
+
+func (b *SqlBuilder) writeUpsert(w *sqlBuildWriter) error {
+	var update []string
+	for _, s := range b.sets {
+		if !SliceContains(b.conflict, s.column) {
+			update = append(update, s.column)
+		}
+	}
+
+	if b.dialect == dialectPostgres {
+		if len(b.conflict) == 0 {
+			return fmt.Errorf("[SqlBuilder] pgsql Upsert 需要指定冲突列")
+		}
+		conflict := make([]string, len(b.conflict))
+		for i, c := range b.conflict {
+			conflict[i] = b.ident(c)
+		}
+		w.WriteString(" ON CONFLICT (" + strings.Join(conflict, ", ") + ") ")
+		if len(update) == 0 {
+			w.WriteString("DO NOTHING")
+			return nil
+		}
+		sets := make([]string, len(update))
+		for i, c := range update {
+			sets[i] = b.ident(c) + " = EXCLUDED." + b.ident(c)
+		}
+		w.WriteString("DO UPDATE SET " + strings.Join(sets, ", "))
+		return nil
+	}
+
+	if len(update) == 0 {
+		// 没有需要更新的列时等同于忽略冲突
+		c := b.ident(b.sets[0].column)
+		w.WriteString(" ON DUPLICATE KEY UPDATE " + c + " = " + c)
+		return nil
+	}
+	sets := make([]string, len(update))
+	for i, c := range update {
+		sets[i] = b.ident(c) + " = VALUES(" + b.ident(c) + ")"
+	}
+	w.WriteString(" ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", "))
+	return nil
+}
+
+// ident 普通标识符(字母数字下划线, 可带 schema. 前缀)加引号, 表达式原样返回
+func (b *SqlBuilder) ident(name string) string {
+	if name == "" || name == "*" {
+		return name
+	}
+	for _, r := range name {
+		if !(r == '_' || r == '.' || r == '*' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return name
+		}
+	}
+	return b.dialect.quote(name)
+}
+
+// sqlBuildWriter 拼接语句并按顺序收集参数
+type sqlBuildWriter struct {
+	strings.Builder
+	dialect sqlDialect
+	args    []interface{}
+	err     error
+}
+
+// bind 写入表达式, 将单引号字符串以外的 ? 替换为方言的占位符
+func (w *sqlBuildWriter) bind(expr string, args []interface{}) {
+	n := 0
+	quoted := false
+	for _, r := range expr {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			if n >= len(args) {
+				w.err = fmt.Errorf("[SqlBuilder] 条件 %q 的参数数量不足", expr)
+				return
+			}
+			w.value(args[n])
+			n++
+			continue
+		}
+		w.WriteRune(r)
+	}
+	if n != len(args) && w.err == nil {
+		w.err = fmt.Errorf("[SqlBuilder] 条件 %q 有 %d 个占位符, 传入 %d 个参数", expr, n, len(args))
+	}
+}
+
+// value 写入一个参数的占位符, SqlExpr 原样写入
+func (w *sqlBuildWriter) value(v interface{}) {
+	if e, ok := v.(SqlExpr); ok {
+		w.WriteString(string(e))
+		return
+	}
+	w.args = append(w.args, v)
+	w.WriteString(w.dialect.placeholder(len(w.args)))
+}
@@ -0,0 +1,170 @@
+package dbHelper
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlDialect sql方言, 用于生成占位符与标识符引用
+type sqlDialect int
+
+const (
+	dialectMysql sqlDialect = iota + 1
+	dialectPostgres
+)
+
+func (d sqlDialect) String() string {
+	switch d {
+	case dialectMysql:
+		return "mysql"
+	case dialectPostgres:
+		return "postgres"
+	}
+	return "unknown"
+}
+
+// quote 引用标识符, 支持 schema.table 形式
+func (d sqlDialect) quote(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		if p == "*" {
+			continue
+		}
+		switch d {
+		case dialectMysql:
+			parts[i] = "`" + strings.ReplaceAll(p, "`", "``") + "`"
+		default:
+			parts[i] = `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// placeholder 第n个参数的占位符, n 从1开始
+func (d sqlDialect) placeholder(n int) string {
+	if d == dialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// getSqlDB 通过标记获取 *sql.DB 及其方言, 先查找mysql配置再查找pgsql配置
+func getSqlDB(tag string) (*sql.DB, sqlDialect, error) {
+	if orm, ok := MysqlConn[tag]; ok {
+		db, err := orm.DB()
+		return db, dialectMysql, err
+	}
+	if db, ok := PgsqlConn[tag]; ok {
+		return db, dialectPostgres, nil
+	}
+	return nil, 0, fmt.Errorf("未找到mysql或pgsql连接 tag = %s", tag)
+}
+
+// scanMaps 将查询结果逐行转换为 map, NULL 为 nil, 整数与浮点列转换为对应数值, 其余 []byte 转换为 string
+func scanMaps(rows *sql.Rows) ([]map[string]interface{}, error) {
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		row, err := scanMapRow(rows, columns)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, row)
+	}
+
+	return list, rows.Err()
+}
+
+// scanMapRow 读取当前行, 调用前需先执行 rows.Next
+func scanMapRow(rows *sql.Rows, columns []*sql.ColumnType) (map[string]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, c := range columns {
+		row[c.Name()] = convertSqlValue(c, values[i])
+	}
+	return row, nil
+}
+
+// convertSqlValue 驱动以 []byte 返回的值按列类型转换, 文本通过 AnyToString 转为 string
+func convertSqlValue(ct *sql.ColumnType, v interface{}) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+
+	typeName := strings.ToUpper(ct.DatabaseTypeName())
+	switch typeName {
+	case "BINARY", "VARBINARY", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BYTEA":
+		return b
+	}
+	str := AnyToString(b)
+	switch typeName {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "YEAR", "INT2", "INT4", "INT8":
+		if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return n
+		}
+	case "UNSIGNED TINYINT", "UNSIGNED SMALLINT", "UNSIGNED MEDIUMINT", "UNSIGNED INT", "UNSIGNED BIGINT":
+		if n, err := strconv.ParseUint(str, 10, 64); err == nil {
+			return n
+		}
+	case "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8":
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			return f
+		}
+	}
+	return str
+}
+
+// literal 将值格式化为sql字面量, 用于生成可直接执行的修复语句
+func (d sqlDialect) literal(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if d == dialectPostgres {
+			if x {
+				return "TRUE"
+			}
+			return "FALSE"
+		}
+		if x {
+			return "1"
+		}
+		return "0"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", x)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case time.Time:
+		return "'" + x.Format("2006-01-02 15:04:05.999999") + "'"
+	case []byte:
+		if d == dialectPostgres {
+			return "'\\x" + hex.EncodeToString(x) + "'::bytea"
+		}
+		return "X'" + hex.EncodeToString(x) + "'"
+	}
+
+	s := strings.ReplaceAll(AnyToString(v), "'", "''")
+	if d == dialectMysql {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + s + "'"
+}
@@ -0,0 +1,328 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// QueryMaps 执行查询并将每行转换为 map, NULL 为 nil, 文本列为 string
+// 适用于 GetPgsqlConn 以及 GetMysqlConn(tag).DB() 得到的 *sql.DB
+func QueryMaps(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	return scanMaps(rows)
+}
+
+// QueryStructs 执行查询并将每行映射到结构体 T (或 *T)
+// 列与字段按 db 标签、json 标签、字段名的蛇形命名依次匹配, NULL 保持字段零值
+func QueryStructs[T any](ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]T, error) {
+	list, err := QueryMaps(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]T, 0, len(list))
+	for _, row := range list {
+		var item T
+		if err = mapToStruct(row, &item); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// QueryOne 执行查询并将第一行映射到结构体 T (或 *T), 只读取第一行, 没有数据时返回 sql.ErrNoRows
+func QueryOne[T any](ctx context.Context, db *sql.DB, query string, args ...interface{}) (T, error) {
+	var item T
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return item, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return item, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return item, err
+		}
+		return item, sql.ErrNoRows
+	}
+	row, err := scanMapRow(rows, columns)
+	if err != nil {
+		return item, err
+	}
+	err = mapToStruct(row, &item)
+	return item, err
+}
+
+// mapToStruct 将一行数据赋值到 dst 指向的结构体, dst 可以是 *struct 或 **struct
+func mapToStruct(row map[string]interface{}, dst interface{}) error {
+	rv := reflect.ValueOf(dst).Elem()
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("[QueryStructs] 不支持的类型 %s, 需要结构体", rv.Type())
+	}
+
+	fields := structColumns(rv.Type())
+	for column, value := range row {
+		index, ok := fields[column]
+		if !ok {
+			continue
+		}
+		fv := rv.FieldByIndex(index)
+		if err := setFieldValue(fv, value); err != nil {
+			return fmt.Errorf("[QueryStructs] 列 %s 赋值失败: %w", column, err)
+		}
+	}
+	return nil
+}
+
+var structColumnsCache sync.Map
+
+// structColumns 结构体的列名 -> 字段索引, 包含匿名嵌入结构体的字段
+func structColumns(t reflect.Type) map[string][]int {
+	if v, ok := structColumnsCache.Load(t); ok {
+		return v.(map[string][]int)
+	}
+
+	columns := make(map[string][]int)
+	var walk func(t reflect.Type, parent []int)
+	walk = func(t reflect.Type, parent []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			index := append(append([]int{}, parent...), i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("db") == "" {
+				walk(f.Type, index)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+
+			name := strings.Split(f.Tag.Get("db"), ",")[0]
+			if name == "" {
+				name = strings.Split(f.Tag.Get("json"), ",")[0]
+			}
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = snakeCase(f.Name)
+			}
+			if _, ok := columns[name]; !ok {
+				columns[name] = index
+			}
+		}
+	}
+	walk(t, nil)
+
+	structColumnsCache.Store(t, columns)
+	return columns
+}
+
+// snakeCase 驼峰转蛇形 UserID -> user_id
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+// setFieldValue 将数据库返回的值赋给字段, nil 保持零值
+func setFieldValue(fv reflect.Value, value interface{}) error {
+	if fv.CanAddr() && fv.Addr().Type().Implements(scannerType) {
+		return fv.Addr().Interface().(sql.Scanner).Scan(value)
+	}
+	if value == nil {
+		return nil
+	}
+	if fv.Kind() == reflect.Ptr {
+		elem := reflect.New(fv.Type().Elem())
+		if err := setFieldValue(elem.Elem(), value); err != nil {
+			return err
+		}
+		fv.Set(elem)
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(fv.Type()) {
+		fv.Set(v)
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(AnyToString(value))
+		return nil
+
+	case reflect.Bool:
+		switch x := value.(type) {
+		case int64:
+			fv.SetBool(x != 0)
+			return nil
+		case string:
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return err
+			}
+			fv.SetBool(b)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := sqlIntValue(value)
+		if err != nil {
+			return err
+		}
+		if fv.OverflowInt(n) {
+			return fmt.Errorf("%v 超出 %s 的范围", value, fv.Type())
+		}
+		fv.SetInt(n)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := sqlUintValue(value)
+		if err != nil {
+			return err
+		}
+		if fv.OverflowUint(n) {
+			return fmt.Errorf("%v 超出 %s 的范围", value, fv.Type())
+		}
+		fv.SetUint(n)
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch x := value.(type) {
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(x, fv.Type().Bits()); err != nil {
+				return err
+			}
+		case bool:
+			if x {
+				f = 1
+			}
+		default:
+			if !v.Type().ConvertibleTo(reflect.TypeOf(f)) {
+				return fmt.Errorf("无法将 %T 转换为 %s", value, fv.Type())
+			}
+			f = v.Convert(reflect.TypeOf(f)).Float()
+		}
+		if fv.OverflowFloat(f) {
+			return fmt.Errorf("%v 超出 %s 的范围", value, fv.Type())
+		}
+		fv.SetFloat(f)
+		return nil
+
+	case reflect.Slice:
+		if s, ok := value.(string); ok && fv.Type().Elem().Kind() == reflect.Uint8 {
+			fv.SetBytes([]byte(s))
+			return nil
+		}
+
+	case reflect.Struct:
+		if s, ok := value.(string); ok && fv.Type() == reflect.TypeOf(time.Time{}) {
+			t, err := time.ParseInLocation(TimeTemplate, s, time.Local)
+			if err != nil {
+				return err
+			}
+			fv.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+
+	return fmt.Errorf("无法将 %T 转换为 %s", value, fv.Type())
+}
+
+// sqlIntValue 数据库返回的值转为 int64, 字符串按十进制整数解析, 浮点数需为整数值
+func sqlIntValue(value interface{}) (int64, error) {
+	switch x := value.(type) {
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	case bool:
+		if x {
+			return 1, nil
+		}
+		return 0, nil
+	case float32:
+		return sqlIntValue(float64(x))
+	case float64:
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v 不是 int64 范围内的整数", x)
+		}
+		return int64(x), nil
+	}
+	if n, ok := anyIntValue(value); ok {
+		return n, nil
+	}
+	if _, ok := value.(uint64); ok {
+		return 0, fmt.Errorf("%v 超出 int64 的范围", value)
+	}
+	if _, ok := value.(uint); ok {
+		return 0, fmt.Errorf("%v 超出 int64 的范围", value)
+	}
+	return 0, fmt.Errorf("无法将 %T 转换为整数", value)
+}
+
+// sqlUintValue 数据库返回的值转为 uint64, 负数返回错误
+func sqlUintValue(value interface{}) (uint64, error) {
+	switch x := value.(type) {
+	case string:
+		return strconv.ParseUint(x, 10, 64)
+	case uint:
+		return uint64(x), nil
+	case uint64:
+		return x, nil
+	case float32:
+		return sqlUintValue(float64(x))
+	case float64:
+		if x != math.Trunc(x) || x < 0 || x >= math.MaxUint64 {
+			return 0, fmt.Errorf("%v 不是 uint64 范围内的整数", x)
+		}
+		return uint64(x), nil
+	}
+	n, err := sqlIntValue(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%v 不能赋值给无符号整数", value)
+	}
+	return uint64(n), nil
+}
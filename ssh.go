@@ -1,12 +1,14 @@
 package dbHelper
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -15,6 +17,7 @@ type sshConfig struct {
 	User       string // ssh 用户
 	Password   string // 密码认证
 	PrivateKey string // 密钥文件路径
+	Passphrase string // 加密私钥的密码
 	RemoteHost string // SSH服务器地址
 	RemotePort int64  // SSH服务器端口
 	LocalHost  string // 本地监听地址
@@ -23,8 +26,8 @@ type sshConfig struct {
 	TargetPort int64  // 目标服务端口
 }
 
-func (s *sshConfig) getSshConn() error {
-	// 配置SSH客户端
+// clientConfig 构建ssh客户端配置, 同时设置密码与私钥时两种认证方式都会尝试, 优先使用密钥认证
+func (s *sshConfig) clientConfig() (*ssh.ClientConfig, error) {
 	config := &ssh.ClientConfig{
 		User: s.User,
 		Auth: []ssh.AuthMethod{},
@@ -36,36 +39,59 @@ func (s *sshConfig) getSshConn() error {
 		Timeout: 10 * time.Second,
 	}
 
-	// 设置认证方法
-	if s.Password != "" {
-		config.Auth = append(config.Auth, ssh.Password(s.Password))
-	}
-
+	// 设置认证方法, 服务端按顺序尝试, 密钥在前
 	if s.PrivateKey != "" {
 		key, err := os.ReadFile(s.PrivateKey)
 		if err != nil {
 			ErrorF("[ssh隧道]读取私钥文件失败: %v", err)
-			return err
+			return nil, err
 		}
 
-		signer, err := ssh.ParsePrivateKey(key)
+		var signer ssh.Signer
+		if s.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(s.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
 		if err != nil {
 			ErrorF("[ssh隧道]解析私钥失败: %v", err)
-			return err
+			return nil, err
 		}
 
 		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
 	}
 
+	if s.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(s.Password))
+	}
+
 	if len(config.Auth) == 0 {
-		return fmt.Errorf("[ssh隧道]必须指定密码或私钥文件进行认证")
+		return nil, fmt.Errorf("[ssh隧道]必须指定密码或私钥文件进行认证")
+	}
+	return config, nil
+}
+
+// dial 连接到SSH服务器
+func (s *sshConfig) dial() (*ssh.Client, error) {
+	config, err := s.clientConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	// 连接到SSH服务器
 	sshAddr := fmt.Sprintf("%s:%d", s.RemoteHost, s.RemotePort)
 	client, err := ssh.Dial("tcp", sshAddr, config)
 	if err != nil {
 		ErrorF("[ssh隧道]连接到SSH服务器失败: %v", err)
+		return nil, err
+	}
+	InfoF("[ssh隧道]已连接到SSH服务器: %s", sshAddr)
+	return client, nil
+}
+
+func (s *sshConfig) getSshConn() error {
+	// 连接到SSH服务器
+	client, err := s.dial()
+	if err != nil {
 		return err
 	}
 
@@ -125,6 +151,85 @@ func (s *sshConfig) getSshConn() error {
 	return nil
 }
 
+// sshDialer 通过ssh客户端直接拨号, 不监听本地端口, 用于支持自定义 Dialer 的客户端(如redis)
+// ssh连接断开后在下一次拨号时重新连接
+type sshDialer struct {
+	conf   *sshConfig
+	mux    sync.Mutex
+	client *ssh.Client
+}
+
+func newSshDialer(conf *sshConfig) *sshDialer {
+	return &sshDialer{conf: conf}
+}
+
+// connect 返回可用的ssh客户端, 未连接或已断开时重新连接
+func (d *sshDialer) connect() (*ssh.Client, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	client, err := d.conf.dial()
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+
+	// 连接断开时清除, 下一次拨号重新连接
+	go func() {
+		err := client.Wait()
+		d.mux.Lock()
+		if d.client == client {
+			d.client = nil
+		}
+		d.mux.Unlock()
+		WarnF("[ssh隧道]与SSH服务器的连接已断开: %v", err)
+	}()
+	return client, nil
+}
+
+// DialContext 通过ssh隧道连接 addr, 拨号失败且ssh连接已不可用时重新连接并重试一次
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		client, err := d.connect()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		ErrorF("[ssh隧道]连接到远程目标失败: %v", err)
+
+		// ssh连接正常时是目标不可达, 不影响隧道上的其他连接
+		if _, _, probeErr := client.SendRequest("keepalive@openssh.com", true, nil); probeErr == nil || i > 0 {
+			return nil, err
+		}
+		d.mux.Lock()
+		if d.client == client {
+			d.client = nil
+		}
+		d.mux.Unlock()
+		_ = client.Close()
+	}
+}
+
+func (d *sshDialer) Close() error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
+
 // 处理每个连接的转发
 func handleConnection(client *ssh.Client, localConn net.Conn, targetHost string, targetPort int64) {
 
@@ -0,0 +1,418 @@
+package dbHelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamClaimPageSize = 100
+	streamClaimPages    = 10
+)
+
+// StreamMessage 从 stream 读取的消息, Attempts 为第几次投递
+type StreamMessage struct {
+	ID       string
+	Stream   string
+	Values   map[string]interface{}
+	Attempts int64
+}
+
+// StreamHandler 处理消息, 返回 nil 时确认消息, 返回错误或 panic 时稍后重试
+type StreamHandler func(ctx context.Context, msg *StreamMessage) error
+
+// StreamWorkerOptions 消费者参数
+type StreamWorkerOptions struct {
+	Group         string        // 消费者组 默认为 SetAppName 设置的项目名称, 未设置时为 dbHelper
+	Consumer      string        // 消费者名称 默认 {hostname}-{随机id}
+	Concurrency   int           // 同时处理的消息数 默认10
+	Block         time.Duration // XREADGROUP 阻塞等待时间, 也是停止时的最长等待 默认2秒
+	MinIdle       time.Duration // 待确认消息空闲超过此时间才会被重新认领, 应大于处理一条消息的最长耗时 默认30秒
+	ClaimInterval time.Duration // 检查待确认消息的间隔 默认5秒
+	MaxAttempts   int64         // 最多投递次数, 超过后移入死信 stream 默认5
+	DeadLetter    string        // 死信 stream 默认 {stream}:dead
+	DrainTimeout  time.Duration // 停止时等待处理中消息的最长时间, 超时后取消 handler 的 ctx 默认30秒
+}
+
+// StreamWorker redis stream 消费者组, 至少一次投递, handler 应保证幂等
+// 处理失败的消息不确认, 空闲超过 MinIdle*2^(n-1) (最长10分钟) 后由任一消费者通过 XCLAIM 重新认领
+type StreamWorker struct {
+	tag     string
+	stream  string
+	handler StreamHandler
+	opt     StreamWorkerOptions
+	slots   chan struct{}
+	cursor  string // XPENDING 下次扫描的起始id, 只在 claimLoop 中使用
+}
+
+// NewStreamWorker 在redis标记上创建 stream 消费者, 调用 Run 开始消费
+func NewStreamWorker(tag, stream string, handler StreamHandler, opt *StreamWorkerOptions) *StreamWorker {
+	GetRedisConn(tag)
+	w := &StreamWorker{tag: tag, stream: stream, handler: handler}
+	if opt != nil {
+		w.opt = *opt
+	}
+	if w.opt.Group == "" {
+		w.opt.Group = std.appName
+	}
+	if w.opt.Group == "" {
+		w.opt.Group = "dbHelper"
+	}
+	if w.opt.Consumer == "" {
+		host, _ := os.Hostname()
+		w.opt.Consumer = host + "-" + GetUUID()[:8]
+	}
+	if w.opt.Concurrency < 1 {
+		w.opt.Concurrency = 10
+	}
+	if w.opt.Block <= 0 {
+		w.opt.Block = 2 * time.Second
+	}
+	if w.opt.MinIdle <= 0 {
+		w.opt.MinIdle = 30 * time.Second
+	}
+	if w.opt.ClaimInterval <= 0 {
+		w.opt.ClaimInterval = 5 * time.Second
+	}
+	if w.opt.MaxAttempts < 1 {
+		w.opt.MaxAttempts = 5
+	}
+	if w.opt.DeadLetter == "" {
+		w.opt.DeadLetter = stream + ":dead"
+	}
+	if w.opt.DrainTimeout <= 0 {
+		w.opt.DrainTimeout = 30 * time.Second
+	}
+	w.slots = make(chan struct{}, w.opt.Concurrency)
+	return w
+}
+
+func (w *StreamWorker) redis() redis.UniversalClient {
+	return GetRedisConn(w.tag)
+}
+
+// Run 创建消费者组(不存在时)并阻塞消费, ctx 结束后停止读取, 等待处理中的消息完成后返回
+func (w *StreamWorker) Run(ctx context.Context) error {
+	if err := w.createGroup(ctx); err != nil {
+		return err
+	}
+	InfoF("[StreamWorker] %s 开始消费 group = %s consumer = %s", w.stream, w.opt.Group, w.opt.Consumer)
+
+	// handler 的 ctx 不随 ctx 立即取消, 停止时给处理中的消息留出 DrainTimeout
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	var (
+		inflight sync.WaitGroup
+		loops    sync.WaitGroup
+	)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		w.claimLoop(ctx, handlerCtx, &inflight)
+	}()
+	w.readLoop(ctx, handlerCtx, &inflight)
+	loops.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(w.opt.DrainTimeout):
+		WarnF("[StreamWorker] %s 等待处理中的消息超时, 取消 handler", w.stream)
+		cancelHandlers()
+		<-done
+	}
+
+	w.removeConsumer()
+	InfoF("[StreamWorker] %s 已停止 consumer = %s", w.stream, w.opt.Consumer)
+	return nil
+}
+
+func (w *StreamWorker) createGroup(ctx context.Context) error {
+	err := w.redis().XGroupCreateMkStream(ctx, w.stream, w.opt.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// acquire 阻塞获取一个处理名额, 再尽量多取空闲名额, 返回取得的数量, ctx 结束时返回0
+func (w *StreamWorker) acquire(ctx context.Context, block bool) int {
+	n := 0
+	if block {
+		select {
+		case <-ctx.Done():
+			return 0
+		case w.slots <- struct{}{}:
+			n++
+		}
+	}
+	for n < w.opt.Concurrency {
+		select {
+		case w.slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func (w *StreamWorker) release(n int) {
+	for i := 0; i < n; i++ {
+		<-w.slots
+	}
+}
+
+func (w *StreamWorker) readLoop(ctx, handlerCtx context.Context, inflight *sync.WaitGroup) {
+	for ctx.Err() == nil {
+		n := w.acquire(ctx, true)
+		if n == 0 {
+			return
+		}
+
+		res, err := w.redis().XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    w.opt.Group,
+			Consumer: w.opt.Consumer,
+			Streams:  []string{w.stream, ">"},
+			Count:    int64(n),
+			Block:    w.opt.Block,
+		}).Result()
+		if err != nil {
+			w.release(n)
+			if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+				continue
+			}
+			// stream 被删除后消费者组也不存在, 重新创建
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				err = w.createGroup(ctx)
+			}
+			if err != nil {
+				ErrorF("[StreamWorker] %s 读取失败: %v", w.stream, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+
+		used := 0
+		for _, s := range res {
+			for _, m := range s.Messages {
+				used++
+				inflight.Add(1)
+				go w.process(handlerCtx, inflight, &StreamMessage{ID: m.ID, Stream: w.stream, Values: m.Values, Attempts: 1})
+			}
+		}
+		w.release(n - used)
+	}
+}
+
+// claimLoop 定期认领空闲超过退避时间的待确认消息, 包括其他消费者崩溃后遗留的消息
+func (w *StreamWorker) claimLoop(ctx, handlerCtx context.Context, inflight *sync.WaitGroup) {
+	ticker := time.NewTicker(w.opt.ClaimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := w.claim(ctx, handlerCtx, inflight); err != nil && ctx.Err() == nil {
+			ErrorF("[StreamWorker] %s 认领待确认消息失败: %v", w.stream, err)
+		}
+	}
+}
+
+// claim 从上次的位置继续扫描待确认消息, 每次最多扫描 streamClaimPages 页, 扫描到末尾后从头开始
+// 避免前100条消息都处于退避中时后面的消息永远不会被认领, 排他区间 "(id" 需要 redis 6.2 及以上
+func (w *StreamWorker) claim(ctx, handlerCtx context.Context, inflight *sync.WaitGroup) error {
+	n := w.acquire(ctx, false)
+	if n == 0 {
+		return nil
+	}
+	used := 0
+	defer func() {
+		w.release(n - used)
+	}()
+
+	var ids []string
+	attempts := make(map[string]int64)
+	for page := 0; page < streamClaimPages && len(ids) < n; page++ {
+		if w.cursor == "" {
+			w.cursor = "-"
+		}
+		pending, err := w.redis().XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: w.stream,
+			Group:  w.opt.Group,
+			Idle:   w.opt.MinIdle,
+			Start:  w.cursor,
+			End:    "+",
+			Count:  streamClaimPageSize,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		var dead []string
+		scanned := 0
+		for _, p := range pending {
+			if len(ids) >= n {
+				break
+			}
+			scanned++
+			if p.RetryCount >= w.opt.MaxAttempts {
+				dead = append(dead, p.ID)
+				attempts[p.ID] = p.RetryCount
+				continue
+			}
+			if p.Idle >= streamBackoff(w.opt.MinIdle, p.RetryCount) {
+				ids = append(ids, p.ID)
+				attempts[p.ID] = p.RetryCount + 1
+			}
+		}
+		if scanned == len(pending) && len(pending) < streamClaimPageSize {
+			w.cursor = "-"
+		} else {
+			w.cursor = "(" + pending[scanned-1].ID
+		}
+
+		// 投递次数已用完但未确认, 通常是处理时进程崩溃, 认领后直接移入死信
+		if len(dead) > 0 {
+			msgs, err := w.xclaim(ctx, dead)
+			if err != nil {
+				return err
+			}
+			for _, m := range msgs {
+				w.deadLetter(&StreamMessage{ID: m.ID, Stream: w.stream, Values: m.Values, Attempts: attempts[m.ID]},
+					fmt.Errorf("投递 %d 次未确认", attempts[m.ID]))
+			}
+		}
+		if w.cursor == "-" {
+			break
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+	msgs, err := w.xclaim(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		used++
+		inflight.Add(1)
+		go w.process(handlerCtx, inflight, &StreamMessage{ID: m.ID, Stream: w.stream, Values: m.Values, Attempts: attempts[m.ID]})
+	}
+	return nil
+}
+
+// xclaim 转移到当前消费者, 期间被其他消费者认领(空闲时间重置)的消息不会返回
+func (w *StreamWorker) xclaim(ctx context.Context, ids []string) ([]redis.XMessage, error) {
+	msgs, err := w.redis().XClaim(ctx, &redis.XClaimArgs{
+		Stream:   w.stream,
+		Group:    w.opt.Group,
+		Consumer: w.opt.Consumer,
+		MinIdle:  w.opt.MinIdle,
+		Messages: ids,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return msgs, err
+}
+
+func (w *StreamWorker) process(ctx context.Context, inflight *sync.WaitGroup, msg *StreamMessage) {
+	defer inflight.Done()
+	defer w.release(1)
+
+	err := w.call(ctx, msg)
+	if err == nil {
+		w.ack(msg.ID)
+		return
+	}
+	WarnF("[StreamWorker] %s 处理消息 %s 第 %d 次失败: %v", w.stream, msg.ID, msg.Attempts, err)
+	if msg.Attempts >= w.opt.MaxAttempts {
+		w.deadLetter(msg, err)
+	}
+}
+
+func (w *StreamWorker) call(ctx context.Context, msg *StreamMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.handler(ctx, msg)
+}
+
+func (w *StreamWorker) ack(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.redis().XAck(ctx, w.stream, w.opt.Group, id).Err(); err != nil {
+		ErrorF("[StreamWorker] %s 确认消息 %s 失败: %v", w.stream, id, err)
+	}
+}
+
+// deadLetter 写入死信 stream 并确认原消息, 死信保留原字段并增加 _id/_stream/_attempts/_error
+func (w *StreamWorker) deadLetter(msg *StreamMessage, cause error) {
+	values := make(map[string]interface{}, len(msg.Values)+4)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["_id"] = msg.ID
+	values["_stream"] = msg.Stream
+	values["_attempts"] = msg.Attempts
+	values["_error"] = cause.Error()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.redis().XAdd(ctx, &redis.XAddArgs{Stream: w.opt.DeadLetter, Values: values}).Err(); err != nil {
+		ErrorF("[StreamWorker] %s 消息 %s 写入死信失败: %v", w.stream, msg.ID, err)
+		return
+	}
+	ErrorF("[StreamWorker] %s 消息 %s 投递 %d 次仍失败, 已移入 %s: %v", w.stream, msg.ID, msg.Attempts, w.opt.DeadLetter, cause)
+	w.ack(msg.ID)
+}
+
+// removeConsumer 停止时删除没有待确认消息的消费者, 避免消费者组中堆积随机名称的消费者
+func (w *StreamWorker) removeConsumer() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pending, err := w.redis().XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   w.stream,
+		Group:    w.opt.Group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: w.opt.Consumer,
+	}).Result()
+	if err != nil || len(pending) > 0 {
+		return
+	}
+	_ = w.redis().XGroupDelConsumer(ctx, w.stream, w.opt.Group, w.opt.Consumer).Err()
+}
+
+// streamBackoff 第n次投递失败后再次认领前需要的空闲时间, 从 minIdle 开始翻倍, 最长10分钟
+func streamBackoff(minIdle time.Duration, n int64) time.Duration {
+	d := minIdle
+	for i := int64(1); i < n && d < 10*time.Minute; i++ {
+		d *= 2
+	}
+	if d > 10*time.Minute {
+		return max(minIdle, 10*time.Minute)
+	}
+	return d
+}
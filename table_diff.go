@@ -0,0 +1,532 @@
+package dbHelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TableDiffSpec 表数据比对参数
+type TableDiffSpec struct {
+	SrcTable      string            // 源表名
+	DstTable      string            // 目标表名或mongo集合名, 为空则与源表同名
+	PrimaryKey    string            // 源表主键, 单列且可排序, 默认 id
+	DstPrimaryKey string            // 目标主键, 为空则按 ColumnMap 映射源主键; mongo 集合中的值需与源主键可比较, 不能是 ObjectId
+	Columns       []string          // 参与比对的源列, 为空则比对源表全部列
+	ColumnMap     map[string]string // 列映射 源列名 -> 目标列名, 未配置的列保持原名
+	ChunkSize     int               // 每个分块的行数 默认1000
+	MaxRows       int               // Missing/Extra/Changed 各最多保存的行数, 超出后只计数 默认10000
+	RepairSQL     io.Writer         // 非空时输出修复目标表的sql, 不受 MaxRows 限制, 仅目标为 mysql/pgsql 时有效
+}
+
+// TableDiffResult 比对结果, Missing 为源有目标无的源行, Extra 为目标有源无的目标行
+// 各类差异最多保存 MaxRows 行, 总数见 MissingCount/ExtraCount/ChangedCount
+type TableDiffResult struct {
+	Chunks         int
+	MismatchChunks int
+	MissingCount   int64
+	ExtraCount     int64
+	ChangedCount   int64
+	Missing        []map[string]interface{}
+	Extra          []map[string]interface{}
+	Changed        []*TableDiffRow
+}
+
+// TableDiffRow 主键相同但内容不同的行, Columns 为不一致的源列名
+type TableDiffRow struct {
+	Key     interface{}
+	Src     map[string]interface{}
+	Dst     map[string]interface{}
+	Columns []string
+}
+
+// IsSame 两个表的数据是否一致
+func (r *TableDiffResult) IsSame() bool {
+	return r.MissingCount == 0 && r.ExtraCount == 0 && r.ChangedCount == 0
+}
+
+// DiffTable 比对 mysql/pgsql 标记的源表与 mysql/pgsql/mongoDB 标记的目标表
+// 按源表主键切分为分块, 两侧为同一种数据库时由数据库计算每个分块的校验和, 只读取校验和不一致的分块逐行比对;
+// mysql↔pgsql 与 sql表↔mongoDB 之间值的文本格式不同, 无法比较校验和, 每个分块都读取两侧的行比对
+func DiffTable(ctx context.Context, srcTag, dstTag string, spec *TableDiffSpec) (*TableDiffResult, error) {
+	if spec == nil || spec.SrcTable == "" {
+		return nil, fmt.Errorf("[DiffTable] 未指定源表")
+	}
+	if spec.DstTable == "" {
+		spec.DstTable = spec.SrcTable
+	}
+	if spec.PrimaryKey == "" {
+		spec.PrimaryKey = "id"
+	}
+	if spec.DstPrimaryKey == "" {
+		spec.DstPrimaryKey = spec.dstColumn(spec.PrimaryKey)
+	}
+	if spec.ChunkSize < 1 {
+		spec.ChunkSize = 1000
+	}
+	if spec.MaxRows < 1 {
+		spec.MaxRows = 10000
+	}
+
+	srcDB, srcDialect, err := getSqlDB(srcTag)
+	if err != nil {
+		return nil, err
+	}
+	src := &sqlDiffSide{db: srcDB, dialect: srcDialect, table: spec.SrcTable, pk: spec.PrimaryKey, columns: spec.Columns}
+	if len(src.columns) == 0 {
+		if src.columns, err = src.columnNames(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &tableDiff{spec: spec, result: &TableDiffResult{}}
+	for _, c := range src.columns {
+		if c != spec.PrimaryKey {
+			d.compare = append(d.compare, c)
+		}
+	}
+	dstColumns := make([]string, len(src.columns))
+	for i, c := range src.columns {
+		dstColumns[i] = spec.dstColumn(c)
+	}
+
+	var dst diffSide
+	if mdb, ok := MongoDBConn[dstTag]; ok {
+		m := &mongoDiffSide{coll: mdb.Collection(spec.DstTable), pk: spec.DstPrimaryKey}
+		if err = m.checkKey(ctx); err != nil {
+			return nil, err
+		}
+		dst = m
+	} else {
+		db, dialect, err := getSqlDB(dstTag)
+		if err != nil {
+			return nil, err
+		}
+		dst = &sqlDiffSide{db: db, dialect: dialect, table: spec.DstTable, pk: spec.DstPrimaryKey, columns: dstColumns}
+		if spec.RepairSQL != nil {
+			d.repair = dialect
+		}
+	}
+	dstSql, serverSum := dst.(*sqlDiffSide)
+	serverSum = serverSum && dstSql.dialect == srcDialect
+
+	var lo interface{}
+	for {
+		hi, err := src.chunkEnd(ctx, lo, spec.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if hi == nil {
+			break
+		}
+		d.result.Chunks++
+
+		if serverSum {
+			a, err := src.checksum(ctx, lo, hi, d.compare)
+			if err != nil {
+				return nil, err
+			}
+			b, err := dstSql.checksum(ctx, lo, hi, spec.dstColumns(d.compare))
+			if err != nil {
+				return nil, err
+			}
+			if a == b {
+				lo = hi
+				continue
+			}
+		}
+
+		srcRows, err := src.rangeRows(ctx, lo, hi, 0)
+		if err != nil {
+			return nil, err
+		}
+		dstRows, err := dst.rangeRows(ctx, lo, hi, 0)
+		if err != nil {
+			return nil, err
+		}
+		mismatch, err := d.diffChunk(srcRows, dstRows)
+		if err != nil {
+			return nil, err
+		}
+		if mismatch {
+			d.result.MismatchChunks++
+		}
+		lo = hi
+	}
+
+	// 源表最后一个主键之后目标表仍有数据, 全部是多出的行
+	for {
+		dstRows, err := dst.rangeRows(ctx, lo, nil, spec.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(dstRows) == 0 {
+			break
+		}
+		d.result.Chunks++
+		d.result.MismatchChunks++
+		for _, row := range dstRows {
+			if err = d.addExtra(row); err != nil {
+				return nil, err
+			}
+		}
+		lo = dstRows[len(dstRows)-1][spec.DstPrimaryKey]
+	}
+
+	result := d.result
+	InfoF("[DiffTable] %s:%s -> %s:%s 分块 %d 不一致分块 %d 缺失 %d 多出 %d 不同 %d",
+		srcTag, spec.SrcTable, dstTag, spec.DstTable, result.Chunks, result.MismatchChunks,
+		result.MissingCount, result.ExtraCount, result.ChangedCount)
+	return result, nil
+}
+
+func (spec *TableDiffSpec) dstColumn(c string) string {
+	if name, ok := spec.ColumnMap[c]; ok && name != "" {
+		return name
+	}
+	return c
+}
+
+func (spec *TableDiffSpec) dstColumns(columns []string) []string {
+	list := make([]string, len(columns))
+	for i, c := range columns {
+		list[i] = spec.dstColumn(c)
+	}
+	return list
+}
+
+// tableDiff 一次比对的状态, 差异超过 MaxRows 后只计数, 修复sql边比对边输出
+type tableDiff struct {
+	spec    *TableDiffSpec
+	result  *TableDiffResult
+	compare []string   // 参与比对的源列, 不含主键
+	repair  sqlDialect // 非0时输出修复sql
+}
+
+// diffChunk 逐行比对主键范围相同的两侧数据, 返回是否有差异
+func (d *tableDiff) diffChunk(srcRows, dstRows []map[string]interface{}) (bool, error) {
+	spec := d.spec
+	dstIndex := make(map[string]map[string]interface{}, len(dstRows))
+	for _, row := range dstRows {
+		dstIndex[diffNormalize(row[spec.DstPrimaryKey])] = row
+	}
+
+	mismatch := false
+	for _, srcRow := range srcRows {
+		key := diffNormalize(srcRow[spec.PrimaryKey])
+		dstRow, ok := dstIndex[key]
+		if !ok {
+			mismatch = true
+			if err := d.addMissing(srcRow); err != nil {
+				return mismatch, err
+			}
+			continue
+		}
+		delete(dstIndex, key)
+
+		changed := make([]string, 0)
+		for _, c := range d.compare {
+			if diffNormalize(srcRow[c]) != diffNormalize(dstRow[spec.dstColumn(c)]) {
+				changed = append(changed, c)
+			}
+		}
+		if len(changed) > 0 {
+			mismatch = true
+			err := d.addChanged(&TableDiffRow{Key: srcRow[spec.PrimaryKey], Src: srcRow, Dst: dstRow, Columns: changed})
+			if err != nil {
+				return mismatch, err
+			}
+		}
+	}
+
+	// 保持目标行原有顺序
+	for _, row := range dstRows {
+		if _, ok := dstIndex[diffNormalize(row[spec.DstPrimaryKey])]; ok {
+			mismatch = true
+			if err := d.addExtra(row); err != nil {
+				return mismatch, err
+			}
+		}
+	}
+	return mismatch, nil
+}
+
+func (d *tableDiff) addMissing(row map[string]interface{}) error {
+	d.result.MissingCount++
+	if len(d.result.Missing) < d.spec.MaxRows {
+		d.result.Missing = append(d.result.Missing, row)
+	}
+	if d.repair == 0 {
+		return nil
+	}
+
+	columns := append([]string{d.spec.PrimaryKey}, d.compare...)
+	names := make([]string, len(columns))
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = d.repair.quote(d.spec.dstColumn(c))
+		values[i] = d.repair.literal(row[c])
+	}
+	_, err := fmt.Fprintf(d.spec.RepairSQL, "INSERT INTO %s (%s) VALUES (%s);\n",
+		d.repair.quote(d.spec.DstTable), strings.Join(names, ", "), strings.Join(values, ", "))
+	return err
+}
+
+func (d *tableDiff) addChanged(row *TableDiffRow) error {
+	d.result.ChangedCount++
+	if len(d.result.Changed) < d.spec.MaxRows {
+		d.result.Changed = append(d.result.Changed, row)
+	}
+	if d.repair == 0 {
+		return nil
+	}
+
+	sets := make([]string, len(row.Columns))
+	for i, c := range row.Columns {
+		sets[i] = d.repair.quote(d.spec.dstColumn(c)) + " = " + d.repair.literal(row.Src[c])
+	}
+	_, err := fmt.Fprintf(d.spec.RepairSQL, "UPDATE %s SET %s WHERE %s = %s;\n",
+		d.repair.quote(d.spec.DstTable), strings.Join(sets, ", "), d.repair.quote(d.spec.DstPrimaryKey), d.repair.literal(row.Key))
+	return err
+}
+
+func (d *tableDiff) addExtra(row map[string]interface{}) error {
+	d.result.ExtraCount++
+	if len(d.result.Extra) < d.spec.MaxRows {
+		d.result.Extra = append(d.result.Extra, row)
+	}
+	if d.repair == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(d.spec.RepairSQL, "DELETE FROM %s WHERE %s = %s;\n",
+		d.repair.quote(d.spec.DstTable), d.repair.quote(d.spec.DstPrimaryKey), d.repair.literal(row[d.spec.DstPrimaryKey]))
+	return err
+}
+
+// diffNormalize 将不同数据库返回的值统一为可比较的字符串
+func diffNormalize(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "\x00NULL"
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case primitive.DateTime:
+		return x.Time().UTC().Format(time.RFC3339Nano)
+	case primitive.ObjectID:
+		return x.Hex()
+	case primitive.Decimal128:
+		return x.String()
+	}
+	return AnyToString(v)
+}
+
+// diffSide 比对的一侧, rangeRows 返回主键在 (lo, hi] 内按主键升序的行, lo/hi 为nil表示不限, limit 为0表示不限
+type diffSide interface {
+	rangeRows(ctx context.Context, lo, hi interface{}, limit int) ([]map[string]interface{}, error)
+}
+
+type sqlDiffSide struct {
+	db      *sql.DB
+	dialect sqlDialect
+	table   string
+	pk      string
+	columns []string
+}
+
+// rangeWhere 主键在 (lo, hi] 内的条件
+func (s *sqlDiffSide) rangeWhere(lo, hi interface{}) (string, []interface{}) {
+	pk := s.dialect.quote(s.pk)
+	where := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if lo != nil {
+		args = append(args, lo)
+		where = append(where, pk+" > "+s.dialect.placeholder(len(args)))
+	}
+	if hi != nil {
+		args = append(args, hi)
+		where = append(where, pk+" <= "+s.dialect.placeholder(len(args)))
+	}
+	if len(where) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func (s *sqlDiffSide) rangeRows(ctx context.Context, lo, hi interface{}, limit int) ([]map[string]interface{}, error) {
+	columns := "*"
+	if len(s.columns) > 0 {
+		cols := make([]string, 0, len(s.columns)+1)
+		if !SliceContains(s.columns, s.pk) {
+			cols = append(cols, s.dialect.quote(s.pk))
+		}
+		for _, c := range s.columns {
+			cols = append(cols, s.dialect.quote(c))
+		}
+		columns = strings.Join(cols, ", ")
+	}
+
+	where, args := s.rangeWhere(lo, hi)
+	query := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s", columns, s.dialect.quote(s.table), where, s.dialect.quote(s.pk))
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	return s.query(ctx, query, args...)
+}
+
+func (s *sqlDiffSide) query(ctx context.Context, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	return scanMaps(rows)
+}
+
+// columnNames 表的全部列名
+func (s *sqlDiffSide) columnNames(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", s.dialect.quote(s.table)))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	return rows.Columns()
+}
+
+// chunkEnd lo 之后第 n 行的主键, 不足 n 行时为最大主键, 没有剩余行时返回 nil; 只读取主键索引
+func (s *sqlDiffSide) chunkEnd(ctx context.Context, lo interface{}, n int) (interface{}, error) {
+	pk := s.dialect.quote(s.pk)
+	where, args := s.rangeWhere(lo, nil)
+	list, err := s.query(ctx, fmt.Sprintf("SELECT %s FROM %s%s ORDER BY %s LIMIT 1 OFFSET %d",
+		pk, s.dialect.quote(s.table), where, pk, n-1), args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) > 0 {
+		return list[0][s.pk], nil
+	}
+	list, err = s.query(ctx, fmt.Sprintf("SELECT MAX(%s) AS %s FROM %s%s", pk, pk, s.dialect.quote(s.table), where), args...)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return list[0][s.pk], nil
+}
+
+// checksum 由数据库计算 (lo, hi] 内的行数与各行 md5 前60位之和, 与行的顺序无关, 只能与同一种数据库的结果比较
+func (s *sqlDiffSide) checksum(ctx context.Context, lo, hi interface{}, columns []string) (string, error) {
+	parts := make([]string, 0, len(columns)+1)
+	for _, c := range append([]string{s.pk}, columns...) {
+		// NULL 与空字符串区分开
+		if s.dialect == dialectMysql {
+			parts = append(parts, fmt.Sprintf("COALESCE(CAST(%s AS CHAR), CHAR(0))", s.dialect.quote(c)))
+		} else {
+			parts = append(parts, fmt.Sprintf("COALESCE(%s::text, chr(1))", s.dialect.quote(c)))
+		}
+	}
+
+	var sum string
+	if s.dialect == dialectMysql {
+		sum = fmt.Sprintf("COALESCE(SUM(CAST(CONV(SUBSTRING(MD5(CONCAT_WS(CHAR(31), %s)), 1, 15), 16, 10) AS UNSIGNED)), 0)",
+			strings.Join(parts, ", "))
+	} else {
+		sum = fmt.Sprintf("COALESCE(SUM(('x' || substr(md5(concat_ws(chr(31), %s)), 1, 15))::bit(60)::bigint), 0)",
+			strings.Join(parts, ", "))
+	}
+
+	where, args := s.rangeWhere(lo, hi)
+	var (
+		count int64
+		total string
+	)
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*), %s FROM %s%s", sum, s.dialect.quote(s.table), where), args...).
+		Scan(&count, &total)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", count, total), nil
+}
+
+type mongoDiffSide struct {
+	coll *mongo.Collection
+	pk   string
+}
+
+// checkKey 检查集合的主键字段可以按源表主键的范围查询, ObjectId 与源表主键无法比较
+func (m *mongoDiffSide) checkKey(ctx context.Context) error {
+	var doc bson.M
+	err := m.coll.FindOne(ctx, bson.M{m.pk: bson.M{"$exists": true}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		n, err := m.coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("[DiffTable] 集合 %s 中没有主键字段 %s, 请设置 DstPrimaryKey", m.coll.Name(), m.pk)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := doc[m.pk].(primitive.ObjectID); ok {
+		return fmt.Errorf("[DiffTable] 集合 %s 的主键字段 %s 为 ObjectId, 无法与源表主键比较, 请设置 DstPrimaryKey 为保存源表主键的字段",
+			m.coll.Name(), m.pk)
+	}
+	return nil
+}
+
+func (m *mongoDiffSide) rangeRows(ctx context.Context, lo, hi interface{}, limit int) ([]map[string]interface{}, error) {
+	cond := bson.M{}
+	if lo != nil {
+		cond["$gt"] = lo
+	}
+	if hi != nil {
+		cond["$lte"] = hi
+	}
+	filter := bson.M{}
+	if len(cond) > 0 {
+		filter[m.pk] = cond
+	}
+
+	opt := options.Find().SetSort(bson.D{{Key: m.pk, Value: 1}})
+	if limit > 0 {
+		opt.SetLimit(int64(limit))
+	}
+	cur, err := m.coll.Find(ctx, filter, opt)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]bson.M, 0)
+	if err = cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	list := make([]map[string]interface{}, len(docs))
+	for i, d := range docs {
+		list[i] = d
+	}
+	return list, nil
+}
@@ -22,6 +22,10 @@ func AnyToString(i interface{}) string {
 	if reflect.ValueOf(i).Kind() == reflect.String {
 		return i.(string)
 	}
+	// 数据库驱动与redis返回的文本为 []byte
+	if b, ok := i.([]byte); ok {
+		return string(b)
+	}
 	var buf bytes.Buffer
 	stringValue(reflect.ValueOf(i), 0, &buf)
 	return buf.String()
@@ -175,6 +179,33 @@ func AnyToInt64(data interface{}) int64 {
 	return int64(AnyToInt(data))
 }
 
+// anyIntValue 整数类型的值转为 int64, 其他类型或超出 int64 范围的无符号数返回 false, 不做字符串与浮点数转换
+func anyIntValue(data interface{}) (int64, bool) {
+	switch v := data.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), uint64(v) <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	}
+	return 0, false
+}
+
 // AnyToArr interface{} -> []interface{}
 func AnyToArr(data interface{}) []interface{} {
 	if v, ok := data.([]interface{}); ok {
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/google/uuid"
+	"hash/fnv"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -80,24 +81,25 @@ func (idw *IdWorker) InitIdWorker(workerId, datacenterId int64) error {
 	idw.lastTimestamp = -1
 	idw.signMask = ^baseValue + 1
 	idw.idLock = &sync.Mutex{}
-	if idw.workerId < 0 || idw.workerId > idw.maxWorkerId {
+	if workerId < 0 || workerId > idw.maxWorkerId {
 		return fmt.Errorf("workerId[%v] is less than 0 or greater than maxWorkerId[%v]",
-			workerId, datacenterId)
+			workerId, idw.maxWorkerId)
 	}
-	if idw.datacenterId < 0 || idw.datacenterId > idw.maxDatacenterId {
+	if datacenterId < 0 || datacenterId > idw.maxDatacenterId {
 		return fmt.Errorf("datacenterId[%d] is less than 0 or greater than maxDatacenterId[%d]",
-			workerId, datacenterId)
+			datacenterId, idw.maxDatacenterId)
 	}
 	idw.workerId = workerId
 	idw.datacenterId = datacenterId
 	return nil
 }
 
-// NextId 返回一个唯一的 INT64 ID
+// NextId 返回一个唯一的 INT64 ID, 时间戳为毫秒
 func (idw *IdWorker) NextId() (int64, error) {
 	idw.idLock.Lock()
-	timestamp := time.Now().UnixNano()
+	timestamp := time.Now().UnixMilli()
 	if timestamp < idw.lastTimestamp {
+		idw.idLock.Unlock()
 		return -1, fmt.Errorf(fmt.Sprintf("Clock moved backwards.  Refusing to generate id for %d milliseconds",
 			idw.lastTimestamp-timestamp))
 	}
@@ -122,22 +124,53 @@ func (idw *IdWorker) NextId() (int64, error) {
 	return id, nil
 }
 
-// tilNextMillis
+// tilNextMillis 同一毫秒的序列号用完时等到下一毫秒
 func (idw *IdWorker) tilNextMillis() int64 {
-	timestamp := time.Now().UnixNano()
-	if timestamp <= idw.lastTimestamp {
-		timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	timestamp := time.Now().UnixMilli()
+	for timestamp <= idw.lastTimestamp {
+		time.Sleep(100 * time.Microsecond)
+		timestamp = time.Now().UnixMilli()
 	}
 	return timestamp
 }
 
+var (
+	idWorker     *IdWorker
+	idWorkerErr  error
+	idWorkerOnce sync.Once
+)
+
+// SetIdWorker 设置 ID64 使用的 workerId 与 datacenterId (0~31), 需要在第一次生成id之前调用
+// 未设置时由主机名和进程号计算, 多个进程可能相同, 部署多个实例时应为每个实例分配不同的值
+func SetIdWorker(workerId, datacenterId int64) error {
+	w := &IdWorker{}
+	if err := w.InitIdWorker(workerId, datacenterId); err != nil {
+		return err
+	}
+	set := false
+	idWorkerOnce.Do(func() {
+		idWorker = w
+		set = true
+	})
+	if !set {
+		return fmt.Errorf("[IdWorker] 已经生成过id, 不能再修改 workerId 与 datacenterId")
+	}
+	return nil
+}
+
+// ID64 使用进程内共享的 IdWorker, 并发调用时由序列号保证不重复
 func ID64() (int64, error) {
-	currWorker := &IdWorker{}
-	err := currWorker.InitIdWorker(1000, 2)
-	if err != nil {
-		return 0, err
+	idWorkerOnce.Do(func() {
+		host, _ := os.Hostname()
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(host))
+		idWorker = &IdWorker{}
+		idWorkerErr = idWorker.InitIdWorker(int64(os.Getpid()%32), int64(h.Sum32()%32))
+	})
+	if idWorkerErr != nil {
+		return 0, idWorkerErr
 	}
-	return currWorker.NextId()
+	return idWorker.NextId()
 }
 
 func ID() int64 {
@@ -146,12 +179,7 @@ func ID() int64 {
 }
 
 func IDStr() string {
-	currWorker := &IdWorker{}
-	err := currWorker.InitIdWorker(1000, 2)
-	if err != nil {
-		return ""
-	}
-	id, err := currWorker.NextId()
+	id, err := ID64()
 	if err != nil {
 		return ""
 	}